@@ -0,0 +1,345 @@
+package talon_access_proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// accessLogEntry is a line of the access log
+type accessLogEntry struct {
+	Time           time.Time
+	RemoteAddr     string
+	Method         string
+	URI            string
+	Protocol       string
+	Status         int
+	Bytes          int64
+	Referer        string
+	UserAgent      string
+	Duration       time.Duration
+	Upstream       string
+	UpstreamStatus int
+	ApplicationID  string
+	RequestID      string
+	TalonRequestID string
+	Error          string
+}
+
+func newAccessLogEntry(r *http.Request, info *requestInfo, w *responseWriter) *accessLogEntry {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return &accessLogEntry{
+		Time:           info.Start,
+		RemoteAddr:     host,
+		Method:         r.Method,
+		URI:            r.RequestURI,
+		Protocol:       r.Proto,
+		Status:         w.status,
+		Bytes:          w.bytes,
+		Referer:        r.Referer(),
+		UserAgent:      r.UserAgent(),
+		Duration:       time.Since(info.Start),
+		Upstream:       info.Upstream,
+		UpstreamStatus: info.UpstreamStatus,
+		ApplicationID:  info.ApplicationID,
+		RequestID:      info.ID,
+		TalonRequestID: info.TalonRequestID,
+		Error:          w.Header().Get("X-TAP-Error"),
+	}
+}
+
+// appendCommon formats e in the Common Log Format followed by the fields of the proxy, e.g.
+// 127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /v1/campaigns HTTP/1.1" 200 2326 request_time=0.012 upstream_status=200 application=1 request_id=...
+func (e *accessLogEntry) appendCommon(buf *bytes.Buffer, combined bool) {
+	buf.WriteString(orDash(e.RemoteAddr))
+	buf.WriteString(" - - [")
+	buf.WriteString(e.Time.Format("02/Jan/2006:15:04:05 -0700"))
+	buf.WriteString("] ")
+	appendQuoted(buf, e.Method+" "+e.URI+" "+e.Protocol)
+	buf.WriteString(" " + strconv.Itoa(e.Status) + " ")
+	if e.Bytes > 0 {
+		buf.WriteString(strconv.FormatInt(e.Bytes, 10))
+	} else {
+		buf.WriteByte('-')
+	}
+	if combined {
+		buf.WriteByte(' ')
+		appendQuoted(buf, orDash(e.Referer))
+		buf.WriteByte(' ')
+		appendQuoted(buf, orDash(e.UserAgent))
+	}
+	buf.WriteString(" request_time=" + strconv.FormatFloat(e.Duration.Seconds(), 'f', 3, 64))
+	buf.WriteString(" upstream_status=")
+	if e.UpstreamStatus > 0 {
+		buf.WriteString(strconv.Itoa(e.UpstreamStatus))
+	} else {
+		buf.WriteByte('-')
+	}
+	buf.WriteString(" application=")
+	appendEscaped(buf, orDash(e.ApplicationID), false)
+	buf.WriteString(" request_id=")
+	appendEscaped(buf, e.RequestID, false)
+	if len(e.TalonRequestID) > 0 {
+		buf.WriteString(" talon_request_id=")
+		appendEscaped(buf, e.TalonRequestID, false)
+	}
+	if len(e.Error) > 0 {
+		buf.WriteString(" error=" + e.Error)
+	}
+	buf.WriteByte('\n')
+}
+
+// appendJSON formats e as a JSON object on a single line
+func (e *accessLogEntry) appendJSON(buf *bytes.Buffer) {
+	line := struct {
+		Time           string  `json:"time"`
+		RemoteAddr     string  `json:"remote_addr"`
+		Method         string  `json:"method"`
+		URI            string  `json:"uri"`
+		Protocol       string  `json:"protocol"`
+		Status         int     `json:"status"`
+		Bytes          int64   `json:"bytes"`
+		Referer        string  `json:"referer,omitempty"`
+		UserAgent      string  `json:"user_agent,omitempty"`
+		Duration       float64 `json:"duration"`
+		Upstream       string  `json:"upstream,omitempty"`
+		UpstreamStatus int     `json:"upstream_status,omitempty"`
+		ApplicationID  string  `json:"application_id,omitempty"`
+		RequestID      string  `json:"request_id"`
+		TalonRequestID string  `json:"talon_request_id,omitempty"`
+		Error          string  `json:"error,omitempty"`
+	}{
+		Time:           e.Time.Format(time.RFC3339Nano),
+		RemoteAddr:     e.RemoteAddr,
+		Method:         e.Method,
+		URI:            e.URI,
+		Protocol:       e.Protocol,
+		Status:         e.Status,
+		Bytes:          e.Bytes,
+		Referer:        e.Referer,
+		UserAgent:      e.UserAgent,
+		Duration:       e.Duration.Seconds(),
+		Upstream:       e.Upstream,
+		UpstreamStatus: e.UpstreamStatus,
+		ApplicationID:  e.ApplicationID,
+		RequestID:      e.RequestID,
+		TalonRequestID: e.TalonRequestID,
+		Error:          e.Error,
+	}
+	// Encode appends a newline
+	json.NewEncoder(buf).Encode(&line)
+}
+
+func orDash(s string) string {
+	if len(s) <= 0 {
+		return "-"
+	}
+	return s
+}
+
+// appendQuoted writes s in double quotes, see appendEscaped
+func appendQuoted(buf *bytes.Buffer, s string) {
+	buf.WriteByte('"')
+	appendEscaped(buf, s, true)
+	buf.WriteByte('"')
+}
+
+// appendEscaped writes s with quotes, backslashes and non printable bytes escaped like Apache does,
+// so a client can not forge log lines or fields. Spaces are only kept in quoted strings.
+func appendEscaped(buf *bytes.Buffer, s string, quoted bool) {
+	const hex = "0123456789abcdef"
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case c == ' ' && quoted:
+			buf.WriteByte(c)
+		case c <= ' ' || c >= 0x7f:
+			buf.WriteString(`\x`)
+			buf.WriteByte(hex[c>>4])
+			buf.WriteByte(hex[c&0xf])
+		default:
+			buf.WriteByte(c)
+		}
+	}
+}
+
+// accessLog writes a line for every proxied request.
+// All methods can be called on a nil *accessLog, in that case nothing is written.
+type accessLog struct {
+	config *AccessLogConfig
+	logger *zap.Logger
+	mu     sync.Mutex
+	out    io.Writer
+	file   *rotatingFile
+	// failing is set after a write failed, only the first error of a series is logged
+	failing bool
+}
+
+func newAccessLog(config *AccessLogConfig, logger *zap.Logger) (*accessLog, error) {
+	l := &accessLog{config: config, logger: logger.With(zap.String("tag", "AccessLog")), out: os.Stdout}
+	if len(config.Path) > 0 && config.Path != "-" {
+		file, err := openRotatingFile(config.Path, config.MaxSize, config.maxAge, config.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		l.out, l.file = file, file
+	}
+	return l, nil
+}
+
+// Log writes the line of a request
+func (l *accessLog) Log(e *accessLogEntry) {
+	if l == nil {
+		return
+	}
+	var buf bytes.Buffer
+	switch l.config.Format {
+	case "json":
+		e.appendJSON(&buf)
+	case "common":
+		e.appendCommon(&buf, false)
+	default:
+		e.appendCommon(&buf, true)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.out.Write(buf.Bytes()); err != nil {
+		if !l.failing {
+			l.logger.Error("Unable to write access log", zap.Error(err))
+		}
+		l.failing = true
+		return
+	}
+	l.failing = false
+}
+
+// Close closes the log file
+func (l *accessLog) Close() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// rotatingFile is a file that is renamed and replaced by a new one once it is larger than maxSize or older than maxAge,
+// rotated files get the time of the rotation as suffix, e.g. access.log.20060102T150405.000
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+	closed bool
+}
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = time.Now()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.file == nil {
+		// the file could not be opened again after a rotation
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	var rotateErr error
+	if f.size > 0 && ((f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize) || (f.maxAge > 0 && time.Since(f.opened) >= f.maxAge)) {
+		if rotateErr = f.rotate(); f.file == nil {
+			return 0, rotateErr
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return n, err
+}
+
+// rotate renames the current file and opens a new one, f.mu must be held.
+// If the rename fails the current file is opened again, so the log continues in it.
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	f.file = nil
+	renameErr := os.Rename(f.path, f.path+"."+time.Now().Format("20060102T150405.000"))
+	if err := f.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	if f.maxBackups > 0 {
+		backups, _ := filepath.Glob(f.path + ".*")
+		// the suffixes sort in the order of rotation
+		sort.Strings(backups)
+		for len(backups) > f.maxBackups {
+			os.Remove(backups[0])
+			backups = backups[1:]
+		}
+	}
+	return nil
+}
+
+// Close closes the file, further writes fail
+func (f *rotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
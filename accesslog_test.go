@@ -0,0 +1,206 @@
+package talon_access_proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestAccessLogFormat(t *testing.T) {
+	entry := &accessLogEntry{
+		Time:           time.Date(2000, 10, 10, 13, 55, 36, 0, time.FixedZone("", -7*3600)),
+		RemoteAddr:     "127.0.0.1",
+		Method:         http.MethodGet,
+		URI:            "/v1/campaigns",
+		Protocol:       "HTTP/1.1",
+		Status:         http.StatusOK,
+		Bytes:          2326,
+		UserAgent:      `curl "7.0"`,
+		Duration:       12 * time.Millisecond,
+		Upstream:       "demo.talon.one",
+		UpstreamStatus: http.StatusOK,
+		ApplicationID:  "1",
+		RequestID:      "abc",
+	}
+
+	t.Run("Common", func(t *testing.T) {
+		var buf bytes.Buffer
+		entry.appendCommon(&buf, false)
+		require.Equal(t, `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /v1/campaigns HTTP/1.1" 200 2326 request_time=0.012 upstream_status=200 application=1 request_id=abc`+"\n", buf.String())
+	})
+
+	t.Run("Combined", func(t *testing.T) {
+		var buf bytes.Buffer
+		entry.appendCommon(&buf, true)
+		require.Equal(t, `127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET /v1/campaigns HTTP/1.1" 200 2326 "-" "curl \"7.0\"" request_time=0.012 upstream_status=200 application=1 request_id=abc`+"\n", buf.String())
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		var buf bytes.Buffer
+		entry.appendJSON(&buf)
+		require.Equal(t, `{"time":"2000-10-10T13:55:36-07:00","remote_addr":"127.0.0.1","method":"GET","uri":"/v1/campaigns","protocol":"HTTP/1.1","status":200,"bytes":2326,"user_agent":"curl \"7.0\"","duration":0.012,"upstream":"demo.talon.one","upstream_status":200,"application_id":"1","request_id":"abc"}`+"\n", buf.String())
+	})
+
+	t.Run("Escaping", func(t *testing.T) {
+		var buf bytes.Buffer
+		appendEscaped(&buf, "a b\n\"c\\", false)
+		require.Equal(t, `a\x20b\x0a\"c\\`, buf.String())
+		buf.Reset()
+		appendQuoted(&buf, "a b\n")
+		require.Equal(t, `"a b\x0a"`, buf.String())
+	})
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tap")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	f, err := openRotatingFile(path, 10, 0, 2)
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		_, err = f.Write([]byte("12345678\n"))
+		require.NoError(t, err)
+		// the suffix of rotated files has millisecond precision
+		time.Sleep(2 * time.Millisecond)
+	}
+	require.NoError(t, f.Close())
+	_, err = f.Write([]byte("closed\n"))
+	require.Error(t, err)
+
+	backups, err := filepath.Glob(path + ".*")
+	require.NoError(t, err)
+	require.Len(t, backups, 2)
+	for _, backup := range backups {
+		data, err := ioutil.ReadFile(backup)
+		require.NoError(t, err)
+		require.Equal(t, "12345678\n", string(data))
+	}
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "12345678\n", string(data))
+
+	t.Run("MaxAge", func(t *testing.T) {
+		f, err := openRotatingFile(path, 0, 10*time.Millisecond, 0)
+		require.NoError(t, err)
+		defer f.Close()
+		_, err = f.Write([]byte("a\n"))
+		require.NoError(t, err)
+		time.Sleep(20 * time.Millisecond)
+		_, err = f.Write([]byte("b\n"))
+		require.NoError(t, err)
+		data, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, "b\n", string(data))
+	})
+
+	t.Run("Rotation fails", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "tap")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "access.log")
+
+		f, err := openRotatingFile(path, 10, 0, 0)
+		require.NoError(t, err)
+		defer f.Close()
+		_, err = f.Write([]byte("12345678\n"))
+		require.NoError(t, err)
+
+		// neither rename nor reopen work without the directory
+		require.NoError(t, os.RemoveAll(dir))
+		_, err = f.Write([]byte("lost\n"))
+		require.Error(t, err)
+
+		// the file is opened again once it is possible
+		require.NoError(t, os.Mkdir(dir, 0755))
+		_, err = f.Write([]byte("a\n"))
+		require.NoError(t, err)
+		data, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, "a\n", string(data))
+	})
+}
+
+func TestAccessLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tap")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	tap, err := New(Config{
+		TalonAPI: server.URL,
+		Logger:   logger,
+		AccessLog: &AccessLogConfig{
+			Format: "json",
+			Path:   path,
+		},
+	})
+	require.NoError(t, err)
+
+	r := httptest.NewRequest(http.MethodPost, "/v2/events?a=1", strings.NewReader("{}"))
+	r.Header.Set("X-Request-ID", "client-1")
+	tap.Handler().ServeHTTP(httptest.NewRecorder(), r)
+
+	// health checks are not logged
+	tap.Handler().ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/.health", nil))
+
+	r = httptest.NewRequest(http.MethodGet, "/v1/campaigns", nil)
+	r.Header.Set("X-TAP-Timeout", "soon")
+	tap.Handler().ServeHTTP(httptest.NewRecorder(), r)
+	tap.Close()
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 2)
+
+	var line map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &line))
+	require.Equal(t, "POST", line["method"])
+	require.Equal(t, "/v2/events?a=1", line["uri"])
+	require.Equal(t, float64(http.StatusCreated), line["status"])
+	require.Equal(t, float64(http.StatusCreated), line["upstream_status"])
+	require.Equal(t, server.Listener.Addr().String(), line["upstream"])
+	require.Equal(t, float64(5), line["bytes"])
+	require.Equal(t, "client-1", line["request_id"])
+	require.Contains(t, line, "duration")
+
+	line = nil
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &line))
+	require.Equal(t, float64(http.StatusBadRequest), line["status"])
+	require.Equal(t, "invalid_timeout", line["error"])
+	require.NotContains(t, line, "upstream_status")
+}
+
+func TestAccessLogWriteError(t *testing.T) {
+	logs := &logBuffer{}
+	logger := zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(logs), zap.InfoLevel))
+	file := &rotatingFile{closed: true}
+	l := &accessLog{config: &AccessLogConfig{Format: "common"}, logger: logger, out: file, file: file}
+
+	l.Log(&accessLogEntry{})
+	l.Log(&accessLogEntry{})
+	lines := logs.Lines(t)
+	require.Len(t, lines, 1)
+	require.Equal(t, "Unable to write access log", lines[0]["msg"])
+}
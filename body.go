@@ -0,0 +1,168 @@
+package talon_access_proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync/atomic"
+
+	"github.com/valyala/bytebufferpool"
+)
+
+// bodyBuffer holds a copy of a request body, small bodies are kept in a pooled
+// memory buffer, bodies larger than limit are spooled to a temporary file.
+// A bodyBuffer is reference counted, it gets released when the owner and all
+// readers created with NewReader have been closed.
+type bodyBuffer struct {
+	limit  int64
+	size   int64
+	mem    *bytebufferpool.ByteBuffer
+	file   *os.File
+	refs   int32
+	closed int32
+}
+
+func newBodyBuffer(limit int64) *bodyBuffer {
+	return &bodyBuffer{
+		limit: limit,
+		mem:   bytebufferpool.Get(),
+		refs:  1,
+	}
+}
+
+func (b *bodyBuffer) Write(p []byte) (int, error) {
+	if b.file == nil && b.size+int64(len(p)) > b.limit {
+		if err := b.spool(); err != nil {
+			return 0, err
+		}
+	}
+	var n int
+	var err error
+	if b.file != nil {
+		n, err = b.file.Write(p)
+	} else {
+		n, err = b.mem.Write(p)
+	}
+	b.size += int64(n)
+	return n, err
+}
+
+// spool moves the memory buffer into a temporary file
+func (b *bodyBuffer) spool() error {
+	file, err := ioutil.TempFile("", "tap-body-")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(b.mem.B); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+	bytebufferpool.Put(b.mem)
+	b.mem = nil
+	b.file = file
+	return nil
+}
+
+// Len returns the size of the buffered body
+func (b *bodyBuffer) Len() int64 {
+	return b.size
+}
+
+// Bytes returns the buffered body if it is kept in memory, nil otherwise
+func (b *bodyBuffer) Bytes() []byte {
+	if b.mem == nil {
+		return nil
+	}
+	return b.mem.B
+}
+
+// NewReader returns a reader that starts at the beginning of the body
+func (b *bodyBuffer) NewReader() io.ReadCloser {
+	atomic.AddInt32(&b.refs, 1)
+	if b.file != nil {
+		return &bodyReader{Reader: io.NewSectionReader(b.file, 0, b.size), buffer: b}
+	}
+	return &bodyReader{Reader: bytes.NewReader(b.mem.B), buffer: b}
+}
+
+// SetRequestBody sets a reader of the body as the body of req and makes it replayable with req.GetBody.
+// The ownership is passed to req, release it with releaseRequestBody once req was sent.
+func (b *bodyBuffer) SetRequestBody(req *http.Request) {
+	req.ContentLength = b.size
+	if b.size == 0 {
+		// an empty body must be http.NoBody, otherwise the transport would use chunked encoding
+		req.Body = http.NoBody
+		req.GetBody = nil
+		b.Close()
+		return
+	}
+	req.Body = b.NewReader()
+	req.GetBody = func() (io.ReadCloser, error) {
+		return b.NewReader(), nil
+	}
+}
+
+// Close releases the owners reference
+func (b *bodyBuffer) Close() error {
+	if !atomic.CompareAndSwapInt32(&b.closed, 0, 1) {
+		return nil
+	}
+	return b.release()
+}
+
+func (b *bodyBuffer) release() error {
+	if atomic.AddInt32(&b.refs, -1) != 0 {
+		return nil
+	}
+	if b.mem != nil {
+		bytebufferpool.Put(b.mem)
+		b.mem = nil
+	}
+	if b.file != nil {
+		name := b.file.Name()
+		err := b.file.Close()
+		os.Remove(name)
+		b.file = nil
+		return err
+	}
+	return nil
+}
+
+type bodyReader struct {
+	io.Reader
+	buffer *bodyBuffer
+	closed int32
+}
+
+func (r *bodyReader) Close() error {
+	if !atomic.CompareAndSwapInt32(&r.closed, 0, 1) {
+		return nil
+	}
+	return r.buffer.release()
+}
+
+// rewindBody prepares req to be sent again, it reports false if the body can not be replayed
+func rewindBody(req *http.Request) bool {
+	if req.Body == nil || req.Body == http.NoBody {
+		return true
+	}
+	if req.GetBody == nil {
+		return false
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return false
+	}
+	req.Body = body
+	return true
+}
+
+// releaseRequestBody releases the bodyBuffer that was passed to req with SetRequestBody
+func releaseRequestBody(req *http.Request) {
+	if r, ok := req.Body.(*bodyReader); ok {
+		r.buffer.Close()
+	}
+}
@@ -0,0 +1,207 @@
+package talon_access_proxy
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// circuitOpenError is returned when the circuits of all upstreams are open
+type circuitOpenError struct {
+	retryAfter time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("Circuit breaker is open, retry after %s", e.retryAfter)
+}
+
+// circuitBreaker stops sending requests to an upstream after too many failures,
+// after OpenDuration a few probe requests are let through (half-open),
+// if they succeed the circuit is closed again
+type circuitBreaker struct {
+	name   string
+	config *CircuitBreakerConfig
+	logger *zap.Logger
+
+	mu        sync.Mutex
+	state     breakerState
+	openUntil time.Time
+	// ring buffer of the last outcomes, true if it was a failure
+	results     []bool
+	resultIndex int
+	resultCount int
+	probes      int
+	successes   int
+}
+
+func newCircuitBreaker(name string, config *CircuitBreakerConfig, logger *zap.Logger) *circuitBreaker {
+	return &circuitBreaker{
+		name:    name,
+		config:  config,
+		logger:  logger.With(zap.String("breaker", name)),
+		results: make([]bool, config.Window),
+	}
+}
+
+// Allow reports whether a request may be sent, if not it returns the duration after which it can be tried again
+func (b *circuitBreaker) Allow() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	switch b.state {
+	case breakerOpen:
+		if now.Before(b.openUntil) {
+			return false, b.openUntil.Sub(now)
+		}
+		b.setState(breakerHalfOpen)
+		b.probes = 0
+		b.successes = 0
+		fallthrough
+	case breakerHalfOpen:
+		if b.probes >= b.config.HalfOpenRequests {
+			return false, b.config.openDuration
+		}
+		b.probes++
+	}
+	return true, 0
+}
+
+// Report records the outcome of a request that was allowed
+func (b *circuitBreaker) Report(failure bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerHalfOpen:
+		if failure {
+			b.open()
+			return
+		}
+		b.successes++
+		if b.successes >= b.config.HalfOpenRequests {
+			b.resultIndex = 0
+			b.resultCount = 0
+			b.setState(breakerClosed)
+		}
+		return
+	case breakerOpen:
+		return
+	}
+
+	b.results[b.resultIndex] = failure
+	b.resultIndex = (b.resultIndex + 1) % len(b.results)
+	if b.resultCount < len(b.results) {
+		b.resultCount++
+	}
+	if b.resultCount < b.config.MinRequests {
+		return
+	}
+	var failures int
+	for i := 0; i < b.resultCount; i++ {
+		if b.results[i] {
+			failures++
+		}
+	}
+	if float64(failures)/float64(b.resultCount) >= b.config.ErrorRate {
+		b.open()
+	}
+}
+
+// Cancel releases a request that was allowed but has no outcome, e.g. because the client went away
+func (b *circuitBreaker) Cancel() {
+	b.mu.Lock()
+	if b.state == breakerHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+	b.mu.Unlock()
+}
+
+// State returns the current state
+func (b *circuitBreaker) State() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *circuitBreaker) open() {
+	b.openUntil = time.Now().Add(b.config.openDuration)
+	b.resultIndex = 0
+	b.resultCount = 0
+	b.setState(breakerOpen)
+}
+
+func (b *circuitBreaker) setState(state breakerState) {
+	if b.state == state {
+		return
+	}
+	b.logger.Warn("Circuit breaker changed state", zap.String("from", b.state.String()), zap.String("to", state.String()))
+	b.state = state
+}
+
+// circuitBreakers holds the circuit breakers for all upstreams (and applications)
+type circuitBreakers struct {
+	config   *CircuitBreakerConfig
+	logger   *zap.Logger
+	mu       sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+func newCircuitBreakers(config *CircuitBreakerConfig, logger *zap.Logger) *circuitBreakers {
+	return &circuitBreakers{
+		config:   config,
+		logger:   logger.With(zap.String("tag", "CircuitBreaker")),
+		breakers: make(map[string]*circuitBreaker),
+	}
+}
+
+// Get returns the circuit breaker for the upstream host and the application
+func (cb *circuitBreakers) Get(host, applicationID string) *circuitBreaker {
+	name := host
+	if cb.config.PerApplication && len(applicationID) > 0 {
+		name = host + "/" + applicationID
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	b, ok := cb.breakers[name]
+	if !ok {
+		b = newCircuitBreaker(name, cb.config, cb.logger)
+		cb.breakers[name] = b
+	}
+	return b
+}
+
+// CircuitBreakers returns the state of all circuit breakers, keyed by upstream host (and application id)
+func (t *Tap) CircuitBreakers() map[string]string {
+	states := make(map[string]string)
+	if t.breakers == nil {
+		return states
+	}
+	t.breakers.mu.Lock()
+	defer t.breakers.mu.Unlock()
+	for name, b := range t.breakers.breakers {
+		states[name] = b.State().String()
+	}
+	return states
+}
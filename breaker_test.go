@@ -0,0 +1,104 @@
+package talon_access_proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	var requests int
+	var status = http.StatusInternalServerError
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	tap, err := New(Config{
+		TalonAPI: server.URL,
+		Logger:   logger,
+		Retry: RetryConfig{
+			Policies: []RetryPolicy{},
+		},
+		CircuitBreaker: &CircuitBreakerConfig{
+			PerApplication: true,
+			Window:         2,
+			MinRequests:    2,
+			OpenDuration:   "50ms",
+		},
+		Application: map[string]*ApplicationConfig{
+			"1": &ApplicationConfig{},
+			"2": &ApplicationConfig{},
+		},
+	})
+	require.NoError(t, err)
+	defer tap.Close()
+
+	send := func(applicationID string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/v1/customer_profiles/1", nil)
+		r.Header.Set("X-TAP-Application", applicationID)
+		w := httptest.NewRecorder()
+		tap.Handler().ServeHTTP(w, r)
+		return w
+	}
+
+	require.Equal(t, http.StatusInternalServerError, send("1").Code)
+	require.Equal(t, http.StatusInternalServerError, send("1").Code)
+	require.Equal(t, "open", tap.CircuitBreakers()[u.Host+"/1"])
+
+	requests = 0
+	w := send("1")
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Equal(t, "1", w.Header().Get("Retry-After"))
+	require.Equal(t, 0, requests)
+
+	// other applications are not affected
+	require.Equal(t, http.StatusInternalServerError, send("2").Code)
+	require.Equal(t, 1, requests)
+
+	// after the OpenDuration a probe is let through
+	status = http.StatusOK
+	time.Sleep(60 * time.Millisecond)
+	require.Equal(t, http.StatusOK, send("1").Code)
+	require.Equal(t, "closed", tap.CircuitBreakers()[u.Host+"/1"])
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	config := &CircuitBreakerConfig{Window: 1, OpenDuration: "1ms", HalfOpenRequests: 2}
+	require.NoError(t, config.setDefaults())
+	b := newCircuitBreaker("test", config, logger)
+
+	ok, _ := b.Allow()
+	require.True(t, ok)
+	b.Report(true)
+	require.Equal(t, breakerOpen, b.State())
+	ok, _ = b.Allow()
+	require.False(t, ok)
+
+	time.Sleep(2 * time.Millisecond)
+	ok, _ = b.Allow()
+	require.True(t, ok)
+	ok, _ = b.Allow()
+	require.True(t, ok)
+	ok, _ = b.Allow()
+	require.False(t, ok)
+	require.Equal(t, breakerHalfOpen, b.State())
+	b.Report(false)
+	b.Cancel()
+	ok, _ = b.Allow()
+	require.True(t, ok)
+	b.Report(false)
+	require.Equal(t, breakerClosed, b.State())
+}
@@ -0,0 +1,357 @@
+package talon_access_proxy
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// perResponseHeaders describe a single upstream response, they are not stored with the entry
+var perResponseHeaders = []string{talonRequestIDHeader, "X-TAP-Upstream", "Server-Timing"}
+
+type cacheEntry struct {
+	key        string
+	statusCode int
+	header     http.Header
+	body       []byte
+	etag       string
+	storedAt   time.Time
+	expires    time.Time
+	// vary holds the values of the request headers listed in the Vary header of the response
+	vary http.Header
+}
+
+func (e *cacheEntry) Fresh(now time.Time) bool {
+	return now.Before(e.expires)
+}
+
+// Matches reports whether req has the same values for the Vary headers as the request of the entry,
+// only one variant is stored per key, other variants are treated as misses and replace it
+func (e *cacheEntry) Matches(req *http.Request) bool {
+	for name, values := range e.vary {
+		if strings.Join(req.Header[name], ",") != strings.Join(values, ",") {
+			return false
+		}
+	}
+	return true
+}
+
+// Response creates a response from the entry
+func (e *cacheEntry) Response(req *http.Request, status string) *http.Response {
+	header := make(http.Header, len(e.header)+2)
+	for k, v := range e.header {
+		header[k] = append([]string(nil), v...)
+	}
+	header.Set("Age", strconv.Itoa(int(time.Since(e.storedAt).Seconds())))
+	header.Set("X-TAP-Cache", status)
+	return &http.Response{
+		Status:        strconv.Itoa(e.statusCode) + " " + http.StatusText(e.statusCode),
+		StatusCode:    e.statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(e.body)),
+		ContentLength: int64(len(e.body)),
+		Request:       req,
+	}
+}
+
+// responseCache is an in memory LRU cache for upstream responses
+type responseCache struct {
+	config *CacheConfig
+	logger *zap.Logger
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+func newResponseCache(config *CacheConfig, logger *zap.Logger) *responseCache {
+	return &responseCache{
+		config:  config,
+		logger:  logger.With(zap.String("tag", "Cache")),
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (c *responseCache) Get(key string) *cacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(element)
+	return element.Value.(*cacheEntry)
+}
+
+func (c *responseCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		c.lru.Remove(element)
+		delete(c.entries, key)
+	}
+}
+
+func (c *responseCache) Set(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[entry.key]; ok {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.config.MaxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// rule returns the cache rule for req, nil if req should not be cached
+func (config *CacheConfig) rule(req *http.Request) *CacheRule {
+	if req.Method != http.MethodGet {
+		return nil
+	}
+	for i := range config.Rules {
+		if matchRoute(config.Rules[i].Path, req.URL.Path) {
+			return &config.Rules[i]
+		}
+	}
+	return nil
+}
+
+// cacheKey identifies a response, it includes the credentials so tenants never share entries
+func cacheKey(req *http.Request) string {
+	h := sha256.New()
+	io.WriteString(h, req.URL.RequestURI())
+	for _, header := range []string{"Authorization", "Api-Key", "Accept", "Accept-Encoding"} {
+		io.WriteString(h, "\n"+header+":"+req.Header.Get(header))
+	}
+	io.WriteString(h, "\n"+getRequestInfo(req.Context()).ApplicationID)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// parseCacheControl parses a Cache-Control header into its directives
+func parseCacheControl(header string) map[string]string {
+	directives := make(map[string]string)
+	for _, directive := range strings.Split(header, ",") {
+		directive = strings.TrimSpace(directive)
+		if len(directive) <= 0 {
+			continue
+		}
+		tokens := strings.SplitN(directive, "=", 2)
+		key := strings.ToLower(strings.TrimSpace(tokens[0]))
+		if len(tokens) == 2 {
+			directives[key] = strings.Trim(strings.TrimSpace(tokens[1]), `"`)
+		} else {
+			directives[key] = ""
+		}
+	}
+	return directives
+}
+
+// varyHeaders returns the request headers listed in the Vary header, ok is false for Vary: *
+func varyHeaders(header http.Header) ([]string, bool) {
+	var names []string
+	for _, value := range header["Vary"] {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil, false
+			}
+			if len(name) > 0 {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return names, true
+}
+
+// responseTTL returns how long res may be cached, 0 if it should not be stored
+func responseTTL(res *http.Response, ttl time.Duration) (time.Duration, bool) {
+	if res.StatusCode != http.StatusOK {
+		return 0, false
+	}
+	if _, ok := varyHeaders(res.Header); !ok {
+		return 0, false
+	}
+	// the response belongs to a single user
+	if len(res.Header.Get("Set-Cookie")) > 0 {
+		return 0, false
+	}
+	cacheControl := parseCacheControl(res.Header.Get("Cache-Control"))
+	if _, ok := cacheControl["no-store"]; ok {
+		return 0, false
+	}
+	if _, ok := cacheControl["private"]; ok {
+		return 0, false
+	}
+	if _, ok := cacheControl["no-cache"]; ok {
+		// store it, but revalidate on every request
+		return 0, true
+	}
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, ok := cacheControl[directive]; ok {
+			if seconds, err := strconv.Atoi(value); err == nil {
+				if maxAge := time.Duration(seconds) * time.Second; maxAge < ttl {
+					ttl = maxAge
+				}
+			}
+			break
+		}
+	}
+	return ttl, true
+}
+
+// cachedRoundTrip serves cacheable GET requests from the cache,
+// stale entries with an ETag are revalidated using If-None-Match
+func (t *Tap) cachedRoundTrip(logger *zap.Logger, req *http.Request, next roundTripFunc) (*http.Response, error) {
+	rule := t.Config.Cache.rule(req)
+	if rule == nil {
+		return next(req)
+	}
+
+	requestCacheControl := parseCacheControl(req.Header.Get("Cache-Control"))
+	if _, ok := requestCacheControl["no-store"]; ok {
+		return next(req)
+	}
+	_, noCache := requestCacheControl["no-cache"]
+
+	key := cacheKey(req)
+	entry := t.cache.Get(key)
+	if entry != nil && !entry.Matches(req) {
+		entry = nil
+	}
+	clientETag := req.Header.Get("If-None-Match")
+
+	if entry != nil && !noCache && entry.Fresh(time.Now()) {
+		logger.Debug("Serving response from cache")
+		if len(clientETag) > 0 && clientETag == entry.etag {
+			return notModified(req, entry), nil
+		}
+		return entry.Response(req, "HIT"), nil
+	}
+
+	if entry != nil && len(entry.etag) > 0 && len(clientETag) <= 0 {
+		// revalidate the stale entry
+		req.Header.Set("If-None-Match", entry.etag)
+		res, err := next(req)
+		req.Header.Del("If-None-Match")
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode == http.StatusNotModified {
+			res.Body.Close()
+			ttl, ok := responseTTL(&http.Response{StatusCode: http.StatusOK, Header: res.Header}, rule.ttl)
+			if !ok {
+				// the response may no longer be stored
+				t.cache.Delete(key)
+				logger.Debug("Removed cache entry")
+				return entry.Response(req, "REVALIDATED"), nil
+			}
+			// entries are shared, so store a refreshed copy
+			refreshed := *entry
+			refreshed.storedAt = time.Now()
+			refreshed.expires = refreshed.storedAt.Add(ttl)
+			t.cache.Set(&refreshed)
+			logger.Debug("Revalidated cache entry")
+			return refreshed.Response(req, "REVALIDATED"), nil
+		}
+		return t.storeResponse(logger, key, rule, req, res), nil
+	}
+
+	res, err := next(req)
+	if err != nil {
+		return nil, err
+	}
+	if len(clientETag) > 0 {
+		// the response depends on the clients conditional header
+		return res, nil
+	}
+	return t.storeResponse(logger, key, rule, req, res), nil
+}
+
+// storeResponse stores res to req in the cache if it is cacheable, it returns a response that can be passed to the client
+func (t *Tap) storeResponse(logger *zap.Logger, key string, rule *CacheRule, req *http.Request, res *http.Response) *http.Response {
+	ttl, ok := responseTTL(res, rule.ttl)
+	if !ok || res.ContentLength > t.Config.Cache.MaxEntrySize {
+		res.Header.Set("X-TAP-Cache", "MISS")
+		return res
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, t.Config.Cache.MaxEntrySize+1))
+	if err != nil || int64(len(body)) > t.Config.Cache.MaxEntrySize {
+		// pass the already read part and the rest of the body to the client
+		res.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), res.Body), res.Body}
+		res.Header.Set("X-TAP-Cache", "MISS")
+		return res
+	}
+	res.Body.Close()
+
+	header := make(http.Header, len(res.Header))
+	for k, v := range res.Header {
+		header[k] = append([]string(nil), v...)
+	}
+	for _, name := range perResponseHeaders {
+		header.Del(name)
+	}
+	names, _ := varyHeaders(res.Header)
+	vary := make(http.Header, len(names))
+	for _, name := range names {
+		vary[name] = append([]string(nil), req.Header[name]...)
+	}
+	now := time.Now()
+	entry := &cacheEntry{
+		key:        key,
+		statusCode: res.StatusCode,
+		header:     header,
+		body:       body,
+		etag:       res.Header.Get("ETag"),
+		storedAt:   now,
+		expires:    now.Add(ttl),
+		vary:       vary,
+	}
+	t.cache.Set(entry)
+	logger.Debug("Stored response in cache", zap.Duration("ttl", ttl), zap.Int("size", len(body)))
+	response := entry.Response(res.Request, "MISS")
+	for _, name := range perResponseHeaders {
+		if values, ok := res.Header[http.CanonicalHeaderKey(name)]; ok {
+			response.Header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	return response
+}
+
+func notModified(req *http.Request, entry *cacheEntry) *http.Response {
+	res := entry.Response(req, "HIT")
+	res.StatusCode = http.StatusNotModified
+	res.Status = "304 Not Modified"
+	res.Body = http.NoBody
+	res.ContentLength = 0
+	res.Header.Del("Content-Length")
+	return res
+}
+
+// servedFromCache reports whether res was served from a cache entry instead of a fresh upstream response
+func servedFromCache(res *http.Response) bool {
+	status := res.Header.Get("X-TAP-Cache")
+	return status == "HIT" || status == "REVALIDATED"
+}
@@ -0,0 +1,214 @@
+package talon_access_proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestResponseTTL(t *testing.T) {
+	ttl := func(status int, cacheControl string) (time.Duration, bool) {
+		res := &http.Response{StatusCode: status, Header: http.Header{}}
+		res.Header.Set("Cache-Control", cacheControl)
+		return responseTTL(res, time.Minute)
+	}
+	d, ok := ttl(http.StatusOK, "")
+	require.True(t, ok)
+	require.Equal(t, time.Minute, d)
+	d, ok = ttl(http.StatusOK, "public, max-age=10")
+	require.True(t, ok)
+	require.Equal(t, 10*time.Second, d)
+	d, ok = ttl(http.StatusOK, "no-cache")
+	require.True(t, ok)
+	require.Equal(t, time.Duration(0), d)
+	_, ok = ttl(http.StatusOK, "no-store")
+	require.False(t, ok)
+	_, ok = ttl(http.StatusNotFound, "")
+	require.False(t, ok)
+	_, ok = ttl(http.StatusOK, "private, max-age=10")
+	require.False(t, ok)
+
+	res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+	res.Header.Set("Set-Cookie", "session=1")
+	_, ok = responseTTL(res, time.Minute)
+	require.False(t, ok)
+
+	res = &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Vary": {"Accept-Language, *"}}}
+	_, ok = responseTTL(res, time.Minute)
+	require.False(t, ok)
+	res.Header.Set("Vary", "Accept-Language, x-custom")
+	_, ok = responseTTL(res, time.Minute)
+	require.True(t, ok)
+	names, ok := varyHeaders(res.Header)
+	require.True(t, ok)
+	require.Equal(t, []string{"Accept-Language", "X-Custom"}, names)
+}
+
+func TestCache(t *testing.T) {
+	var requests, revalidations int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("X-Request-Id", "talon-"+strconv.Itoa(requests))
+		etag := `"` + r.URL.Path + r.Header.Get("Authorization") + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			revalidations++
+			if len(r.Header.Get("X-Private")) > 0 {
+				w.Header().Set("Cache-Control", "private")
+			}
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer server.Close()
+
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	tap, err := New(Config{
+		TalonAPI: server.URL,
+		Logger:   logger,
+		Cache: &CacheConfig{
+			MaxEntries: 2,
+			Rules: []CacheRule{
+				{Path: "/v1/applications/*", TTL: "50ms"},
+			},
+		},
+		Application: map[string]*ApplicationConfig{
+			"1": &ApplicationConfig{APIKey: "key1"},
+			"2": &ApplicationConfig{APIKey: "key2"},
+		},
+	})
+	require.NoError(t, err)
+	defer tap.Close()
+
+	send := func(path, applicationID string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("X-TAP-Application", applicationID)
+		for i := 0; i+1 < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		tap.Handler().ServeHTTP(w, r)
+		return w
+	}
+	body := func(w *httptest.ResponseRecorder) string {
+		data, err := ioutil.ReadAll(w.Body)
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	w := send("/v1/applications/1", "1")
+	require.Equal(t, "MISS", w.Header().Get("X-TAP-Cache"))
+	require.Equal(t, "ApiKey-v1 key1", body(w))
+	require.NotEmpty(t, w.Header().Get("X-TAP-Upstream"))
+
+	// headers of the upstream response are not stored
+	entry := tap.cache.Get(cacheKeyFor(t, tap, "/v1/applications/1", "1"))
+	require.NotNil(t, entry)
+	require.Empty(t, entry.header.Get("X-Request-Id"))
+	require.Empty(t, entry.header.Get("X-TAP-Upstream"))
+
+	w = send("/v1/applications/1", "1")
+	require.Equal(t, "HIT", w.Header().Get("X-TAP-Cache"))
+	require.Equal(t, "ApiKey-v1 key1", body(w))
+	require.Empty(t, w.Header().Get("X-TAP-Upstream"))
+	require.Equal(t, 1, requests)
+
+	// other applications never see the entry
+	w = send("/v1/applications/1", "2")
+	require.Equal(t, "MISS", w.Header().Get("X-TAP-Cache"))
+	require.Equal(t, "ApiKey-v1 key2", body(w))
+	require.Equal(t, 2, requests)
+
+	// clients conditional request
+	w = send("/v1/applications/1", "1", "If-None-Match", `"/v1/applications/1ApiKey-v1 key1"`)
+	require.Equal(t, http.StatusNotModified, w.Code)
+	require.Equal(t, 2, requests)
+
+	// no-store bypasses the cache
+	w = send("/v1/applications/1", "1", "Cache-Control", "no-store")
+	require.Empty(t, w.Header().Get("X-TAP-Cache"))
+	require.Equal(t, 3, requests)
+
+	// stale entries are revalidated
+	time.Sleep(60 * time.Millisecond)
+	w = send("/v1/applications/1", "1")
+	require.Equal(t, "REVALIDATED", w.Header().Get("X-TAP-Cache"))
+	require.Equal(t, "ApiKey-v1 key1", body(w))
+	require.Equal(t, 1, revalidations)
+
+	// paths without rule are not cached
+	w = send("/v1/campaigns", "1")
+	require.Empty(t, w.Header().Get("X-TAP-Cache"))
+
+	// lru eviction
+	send("/v1/applications/2", "1")
+	require.Nil(t, tap.cache.Get(cacheKeyFor(t, tap, "/v1/applications/1", "2")))
+	require.NotNil(t, tap.cache.Get(cacheKeyFor(t, tap, "/v1/applications/1", "1")))
+
+	// entries are removed if the revalidation may not be stored
+	time.Sleep(60 * time.Millisecond)
+	w = send("/v1/applications/1", "1", "X-Private", "1")
+	require.Equal(t, "REVALIDATED", w.Header().Get("X-TAP-Cache"))
+	require.Equal(t, "ApiKey-v1 key1", body(w))
+	require.Equal(t, 2, revalidations)
+	require.Nil(t, tap.cache.Get(cacheKeyFor(t, tap, "/v1/applications/1", "1")))
+}
+
+func TestCacheVary(t *testing.T) {
+	var requests int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte(r.Header.Get("Accept-Language")))
+	}))
+	defer server.Close()
+
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	tap, err := New(Config{
+		TalonAPI: server.URL,
+		Logger:   logger,
+		Cache: &CacheConfig{
+			Rules: []CacheRule{
+				{Path: "/v1/attributes", TTL: "1m"},
+			},
+		},
+	})
+	require.NoError(t, err)
+	defer tap.Close()
+
+	send := func(language string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/v1/attributes", nil)
+		r.Header.Set("Accept-Language", language)
+		w := httptest.NewRecorder()
+		tap.Handler().ServeHTTP(w, r)
+		return w
+	}
+
+	require.Equal(t, "MISS", send("en").Header().Get("X-TAP-Cache"))
+	w := send("en")
+	require.Equal(t, "HIT", w.Header().Get("X-TAP-Cache"))
+	require.Equal(t, "en", w.Body.String())
+
+	// other variants are not served from the entry
+	w = send("de")
+	require.Equal(t, "MISS", w.Header().Get("X-TAP-Cache"))
+	require.Equal(t, "de", w.Body.String())
+	require.Equal(t, 2, requests)
+	require.Equal(t, "HIT", send("de").Header().Get("X-TAP-Cache"))
+}
+
+func cacheKeyFor(t *testing.T, tap *Tap, path, applicationID string) string {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	r.Header.Set("Authorization", "ApiKey-v1 "+tap.Config.Application[applicationID].APIKey)
+	info := &requestInfo{ApplicationID: applicationID}
+	return cacheKey(r.WithContext(withRequestInfo(r.Context(), info)))
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	hjson "github.com/Eun/hjson-go"
 	"github.com/Eun/microhelpers"
@@ -20,7 +21,13 @@ type Config struct {
 	Address        string
 	Root           string
 	MaxConnections *int
-	tap.Config     `mapstructure:",squash"`
+	// ShutdownDelay is the time between failing the readiness check and closing the listener (Default is 0s)
+	ShutdownDelay string
+	shutdownDelay time.Duration
+	// ShutdownGracePeriod is the maximum time to wait for in-flight requests when shutting down (Default is 30s)
+	ShutdownGracePeriod string
+	shutdownGracePeriod time.Duration
+	tap.Config          `mapstructure:",squash"`
 }
 
 func readConfigs() ([]Config, error) {
@@ -125,6 +132,21 @@ func readConfig(dat map[string]interface{}) (config Config, err error) {
 
 	config.Logger = config.Logger.With(zap.String("address", config.Address), zap.String("api", config.TalonAPI))
 
+	if len(config.ShutdownDelay) <= 0 {
+		config.ShutdownDelay = "0s"
+	}
+	config.shutdownDelay, err = time.ParseDuration(config.ShutdownDelay)
+	if err != nil {
+		return config, fmt.Errorf("Unable to parse ShutdownDelay: %s", err.Error())
+	}
+	if len(config.ShutdownGracePeriod) <= 0 {
+		config.ShutdownGracePeriod = "30s"
+	}
+	config.shutdownGracePeriod, err = time.ParseDuration(config.ShutdownGracePeriod)
+	if err != nil {
+		return config, fmt.Errorf("Unable to parse ShutdownGracePeriod: %s", err.Error())
+	}
+
 	if config.MaxConnections == nil {
 		config.Config.MaxConnections = 100
 	} else {
@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/hjson/hjson-go"
 	"github.com/stretchr/testify/require"
@@ -67,6 +68,28 @@ func TestReadConfigs(t *testing.T) {
 			require.Equal(t, 200, configs[0].Config.MaxConnections)
 		})
 	})
+	t.Run("Shutdown", func(t *testing.T) {
+		t.Run("No Setting Should Resolve to Default Value", func(t *testing.T) {
+			file := createConfig(t, map[string]interface{}{})
+			os.Setenv("APP_CONFIG", file)
+			defer os.Remove(file)
+			defer os.Unsetenv("APP_CONFIG")
+			configs, err := readConfigs()
+			require.NoError(t, err)
+			require.Equal(t, time.Duration(0), configs[0].shutdownDelay)
+			require.Equal(t, 30*time.Second, configs[0].shutdownGracePeriod)
+		})
+		t.Run("Invalid Value", func(t *testing.T) {
+			file := createConfig(t, map[string]interface{}{
+				"ShutdownGracePeriod": "soon",
+			})
+			os.Setenv("APP_CONFIG", file)
+			defer os.Remove(file)
+			defer os.Unsetenv("APP_CONFIG")
+			_, err := readConfigs()
+			require.Error(t, err)
+		})
+	})
 	t.Run("Multiple Config Files", func(t *testing.T) {
 		file := createConfig(t, []map[string]interface{}{
 			map[string]interface{}{
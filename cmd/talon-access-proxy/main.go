@@ -3,11 +3,14 @@ package main
 //go:generate go run generate.go
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"os/signal"
@@ -92,13 +95,20 @@ Sample Config:
 
 	errChan := make(chan error)
 
+	var instances []*instance
 	for i := 0; i < len(configs); i++ {
 		defer configs[i].Logger.Sync()
-		go runConfig(configs[i], errChan)
+		inst, err := newInstance(configs[i])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+			os.Exit(1)
+		}
+		instances = append(instances, inst)
+		go inst.run(errChan)
 	}
 
-	signalChan := make(chan os.Signal)
-	signal.Notify(signalChan, os.Interrupt, os.Kill)
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt, syscall.SIGTERM)
 
 	select {
 	case err := <-errChan:
@@ -107,15 +117,34 @@ Sample Config:
 			os.Exit(1)
 		}
 	case <-signalChan:
-		return
+		// a second signal stops immediately
+		go func() {
+			<-signalChan
+			os.Exit(1)
+		}()
+		var wg sync.WaitGroup
+		for _, inst := range instances {
+			wg.Add(1)
+			go func(inst *instance) {
+				defer wg.Done()
+				inst.shutdown()
+			}(inst)
+		}
+		wg.Wait()
 	}
 }
 
-func runConfig(config Config, errChan chan<- error) {
+// instance is a tap that is served on an address
+type instance struct {
+	config Config
+	tap    *tap.Tap
+	server *http.Server
+}
+
+func newInstance(config Config) (*instance, error) {
 	tap, err := tap.New(config.Config)
 	if err != nil {
-		errChan <- fmt.Errorf("Unable to create tap: %s", err.Error())
-		return
+		return nil, fmt.Errorf("Unable to create tap: %s", err.Error())
 	}
 
 	config.Logger.Debug("Config", zap.String("talon", config.TalonAPI))
@@ -130,11 +159,42 @@ func runConfig(config Config, errChan chan<- error) {
 		handler = mux
 	}
 
-	config.Logger.Info("Listening")
-	if err := http.ListenAndServe(config.Address, handler); err != nil {
+	return &instance{
+		config: config,
+		tap:    tap,
+		server: &http.Server{
+			Addr:    config.Address,
+			Handler: handler,
+		},
+	}, nil
+}
+
+func (i *instance) run(errChan chan<- error) {
+	i.config.Logger.Info("Listening")
+	if err := i.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 		errChan <- fmt.Errorf("Listen Error: %s", err.Error())
 	}
-	tap.Close()
+}
+
+// shutdown fails the readiness check, waits ShutdownDelay for load balancers to notice,
+// then stops accepting connections and waits up to ShutdownGracePeriod for in-flight requests
+func (i *instance) shutdown() {
+	logger := i.config.Logger
+	logger.Info("Shutting down", zap.Duration("delay", i.config.shutdownDelay), zap.Duration("gracePeriod", i.config.shutdownGracePeriod))
+	i.tap.Drain()
+	time.Sleep(i.config.shutdownDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), i.config.shutdownGracePeriod)
+	defer cancel()
+	if err := i.server.Shutdown(ctx); err != nil {
+		logger.Warn("Grace period expired, closing remaining connections", zap.String("error", err.Error()))
+		i.server.Close()
+	}
+	// the handlers of closed connections can still wait for the Talon API, give them the rest of the grace period
+	if err := i.tap.Shutdown(ctx); err != nil {
+		logger.Warn("Grace period expired, requests to the Talon API are still in flight", zap.String("error", err.Error()))
+	}
+	logger.Info("Shut down")
 }
 
 func checkUpdates() {
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	tap "github.com/talon-one/talon-access-proxy"
+	"go.uber.org/zap"
+)
+
+func TestShutdown(t *testing.T) {
+	started := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer upstream.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+	listener.Close()
+
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	inst, err := newInstance(Config{
+		Address:             address,
+		Root:                "/",
+		shutdownDelay:       50 * time.Millisecond,
+		shutdownGracePeriod: time.Second,
+		Config: tap.Config{
+			TalonAPI: upstream.URL,
+			Logger:   logger,
+		},
+	})
+	require.NoError(t, err)
+	errChan := make(chan error, 1)
+	go inst.run(errChan)
+
+	// wait for the listener
+	var res *http.Response
+	for i := 0; i < 100; i++ {
+		if res, err = http.Get("http://" + address + "/.ready"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+
+	status := make(chan int, 1)
+	go func() {
+		res, err := http.Get("http://" + address + "/v1/campaigns")
+		if err != nil {
+			status <- 0
+			return
+		}
+		res.Body.Close()
+		status <- res.StatusCode
+	}()
+	<-started
+
+	done := make(chan struct{})
+	go func() {
+		inst.shutdown()
+		close(done)
+	}()
+
+	// readiness fails during the shutdown delay
+	time.Sleep(20 * time.Millisecond)
+	res, err = http.Get("http://" + address + "/.ready")
+	require.NoError(t, err)
+	res.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+
+	// the in-flight request is completed
+	require.Equal(t, http.StatusOK, <-status)
+	<-done
+	_, err = http.Get("http://" + address + "/.ready")
+	require.Error(t, err)
+	require.Len(t, errChan, 0)
+}
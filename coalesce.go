@@ -0,0 +1,146 @@
+package talon_access_proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+// coalescedCall is an upstream request that identical requests wait for
+type coalescedCall struct {
+	done    chan struct{}
+	waiters int
+	res     *http.Response
+	err     error
+	// upstream and upstreamStatus of the request, the waiters report them as their own
+	upstream       string
+	upstreamStatus int
+	// bodies holds a body reader for every waiter
+	bodies chan io.ReadCloser
+}
+
+// Response creates a copy of the response for a client
+func (c *coalescedCall) Response(req *http.Request, body io.ReadCloser) *http.Response {
+	res := *c.res
+	res.Header = make(http.Header, len(c.res.Header)+1)
+	for k, v := range c.res.Header {
+		res.Header[k] = append([]string(nil), v...)
+	}
+	res.Header.Set("X-TAP-Coalesced", "true")
+	res.Request = req
+	res.Body = body
+	return &res
+}
+
+// coalescer makes sure only one of identical concurrent GET requests is sent upstream
+type coalescer struct {
+	tap   *Tap
+	mu    sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+func newCoalescer(t *Tap) *coalescer {
+	return &coalescer{
+		tap:   t,
+		calls: make(map[string]*coalescedCall),
+	}
+}
+
+func (c *coalescer) match(req *http.Request) bool {
+	if req.Method != http.MethodGet {
+		return false
+	}
+	if len(c.tap.Config.Coalesce.Paths) <= 0 {
+		return true
+	}
+	for _, p := range c.tap.Config.Coalesce.Paths {
+		if matchRoute(p, req.URL.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Do sends req using next, unless an identical request is already in flight,
+// in that case it waits for its response
+func (c *coalescer) Do(logger *zap.Logger, req *http.Request, next roundTripFunc) (*http.Response, error) {
+	if !c.match(req) {
+		return next(req)
+	}
+
+	// the key includes the credentials, so different tenants never share a response
+	key := req.Method + " " + cacheKey(req)
+
+	c.mu.Lock()
+	if call, ok := c.calls[key]; ok {
+		call.waiters++
+		c.mu.Unlock()
+		logger.Debug("Waiting for identical request")
+		select {
+		case <-call.done:
+		case <-req.Context().Done():
+			// release the body reader that is reserved for us
+			c.tap.wg.Add(1)
+			go func() {
+				defer c.tap.wg.Done()
+				<-call.done
+				if call.err == nil {
+					(<-call.bodies).Close()
+				}
+			}()
+			return nil, req.Context().Err()
+		}
+		if call.err != nil {
+			if req.Context().Err() == nil && (isError(call.err, context.Canceled) || isError(call.err, context.DeadlineExceeded)) {
+				// the client of the first request went away or had a shorter timeout, send our own request
+				atomic.AddUint64(&c.tap.stats.coalesceFallbacks, 1)
+				return next(req)
+			}
+			atomic.AddUint64(&c.tap.stats.coalescedRequests, 1)
+			return nil, call.err
+		}
+		atomic.AddUint64(&c.tap.stats.coalescedRequests, 1)
+		info := getRequestInfo(req.Context())
+		info.Upstream, info.UpstreamStatus = call.upstream, call.upstreamStatus
+		return call.Response(req, <-call.bodies), nil
+	}
+	call := &coalescedCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	res, err := next(req)
+	var body *bodyBuffer
+	if err == nil {
+		// buffer the body, so it can be shared with the waiting clients
+		body, err = readBody(res.Body, c.tap.Config.BodyMemoryLimit)
+		res.Body.Close()
+	}
+	call.res, call.err = res, err
+	info := getRequestInfo(req.Context())
+	call.upstream, call.upstreamStatus = info.Upstream, info.UpstreamStatus
+
+	// no waiters can join after the call was removed
+	c.mu.Lock()
+	delete(c.calls, key)
+	c.mu.Unlock()
+
+	if err != nil {
+		close(call.done)
+		return nil, err
+	}
+
+	call.bodies = make(chan io.ReadCloser, call.waiters)
+	for i := 0; i < call.waiters; i++ {
+		call.bodies <- body.NewReader()
+	}
+	close(call.done)
+
+	own := call.Response(req, body.NewReader())
+	own.Header.Del("X-TAP-Coalesced")
+	body.Close()
+	return own, nil
+}
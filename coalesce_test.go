@@ -0,0 +1,169 @@
+package talon_access_proxy
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestCoalesce(t *testing.T) {
+	var requests int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		<-release
+		w.Write([]byte(r.Header.Get("Authorization")))
+	}))
+	defer server.Close()
+
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	tap, err := New(Config{
+		TalonAPI: server.URL,
+		Logger:   logger,
+		Coalesce: &CoalesceConfig{
+			Paths: []string{"/v1/customer_profiles/*"},
+		},
+		Application: map[string]*ApplicationConfig{
+			"1": &ApplicationConfig{APIKey: "key1"},
+			"2": &ApplicationConfig{APIKey: "key2"},
+		},
+	})
+	require.NoError(t, err)
+	defer tap.Close()
+
+	const clients = 5
+	var wg sync.WaitGroup
+	bodies := make([]string, clients*2)
+	for i := 0; i < clients*2; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodGet, "/v1/customer_profiles/1", nil)
+			if i < clients {
+				r.Header.Set("X-TAP-Application", "1")
+			} else {
+				r.Header.Set("X-TAP-Application", "2")
+			}
+			w := httptest.NewRecorder()
+			tap.Handler().ServeHTTP(w, r)
+			bodies[i] = w.Body.String()
+		}(i)
+	}
+
+	// wait until all clients are waiting
+	for i := 0; i < 100 && coalesceWaiters(tap) < (clients-1)*2; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	require.EqualValues(t, 2, atomic.LoadInt32(&requests))
+	require.EqualValues(t, (clients-1)*2, tap.Stats().CoalescedRequests)
+	for i := 0; i < clients; i++ {
+		require.Equal(t, "ApiKey-v1 key1", bodies[i])
+		require.Equal(t, "ApiKey-v1 key2", bodies[clients+i])
+	}
+}
+
+// coalesceWaiters returns the number of requests that wait for an identical request
+func coalesceWaiters(tap *Tap) int {
+	tap.coalescer.mu.Lock()
+	defer tap.coalescer.mu.Unlock()
+	var waiters int
+	for _, call := range tap.coalescer.calls {
+		waiters += call.waiters
+	}
+	return waiters
+}
+
+func TestCoalesceWaiter(t *testing.T) {
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	tap, err := New(Config{
+		TalonAPI: "http://127.0.0.1",
+		Logger:   logger,
+		Coalesce: &CoalesceConfig{},
+	})
+	require.NoError(t, err)
+	defer tap.Close()
+
+	newRequest := func(ctx context.Context) (*http.Request, *requestInfo) {
+		info := &requestInfo{}
+		return httptest.NewRequest(http.MethodGet, "/v1/campaigns", nil).WithContext(withRequestInfo(ctx, info)), info
+	}
+	// leader sends req as first request, its upstream answers once release is closed
+	leader := func(req *http.Request, release chan struct{}, err error) {
+		go tap.coalescer.Do(logger, req, func(req *http.Request) (*http.Response, error) {
+			<-release
+			if err != nil {
+				return nil, err
+			}
+			info := getRequestInfo(req.Context())
+			info.Upstream, info.UpstreamStatus = "primary:443", http.StatusOK
+			return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: ioutil.NopCloser(strings.NewReader("ok"))}, nil
+		})
+		for i := 0; i < 100; i++ {
+			tap.coalescer.mu.Lock()
+			n := len(tap.coalescer.calls)
+			tap.coalescer.mu.Unlock()
+			if n > 0 {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	// wait sends req as identical request and releases the leader once it waits
+	wait := func(req *http.Request, release chan struct{}, next roundTripFunc) (*http.Response, error) {
+		go func() {
+			for i := 0; i < 100 && coalesceWaiters(tap) < 1; i++ {
+				time.Sleep(time.Millisecond)
+			}
+			close(release)
+		}()
+		return tap.coalescer.Do(logger, req, next)
+	}
+
+	t.Run("Response", func(t *testing.T) {
+		release := make(chan struct{})
+		req, _ := newRequest(context.Background())
+		leader(req, release, nil)
+
+		req, info := newRequest(context.Background())
+		res, err := wait(req, release, nil)
+		require.NoError(t, err)
+		res.Body.Close()
+		require.Equal(t, "true", res.Header.Get("X-TAP-Coalesced"))
+		require.Equal(t, "primary:443", info.Upstream)
+		require.Equal(t, http.StatusOK, info.UpstreamStatus)
+		require.Equal(t, Stats{CoalescedRequests: 1}, tap.Stats())
+	})
+
+	t.Run("Fallback", func(t *testing.T) {
+		release := make(chan struct{})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		req, _ := newRequest(ctx)
+		leader(req, release, context.Canceled)
+
+		req, _ = newRequest(context.Background())
+		var sent bool
+		_, err := wait(req, release, func(req *http.Request) (*http.Response, error) {
+			sent = true
+			return nil, errors.New("own request")
+		})
+		require.EqualError(t, err, "own request")
+		require.True(t, sent)
+		require.Equal(t, Stats{CoalescedRequests: 1, CoalesceFallbacks: 1}, tap.Stats())
+	})
+}
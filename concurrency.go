@@ -0,0 +1,230 @@
+package talon_access_proxy
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// overloadedError is returned when a request is shed because too many requests are in flight
+type overloadedError struct {
+	reason     string
+	retryAfter time.Duration
+}
+
+func (e *overloadedError) Error() string {
+	return fmt.Sprintf("Proxy is overloaded (%s), retry after %s", e.reason, e.retryAfter)
+}
+
+// concurrencyLimiter bounds the requests that are in flight, the limit adapts to the latency of the Talon API (AIMD).
+// When the latency stays below Tolerance times the lowest latency of the last Window the limit grows by one per limit requests,
+// otherwise it is multiplied with Backoff. Requests above the limit wait in a FIFO queue.
+// All methods can be called on a nil *concurrencyLimiter, in that case requests are not limited.
+type concurrencyLimiter struct {
+	config *ConcurrencyConfig
+	logger *zap.Logger
+
+	mu       sync.Mutex
+	limit    float64
+	inflight int
+	queue    list.List
+	// lowest latency of the current and the previous window
+	minLatency         time.Duration
+	previousMinLatency time.Duration
+	windowStart        time.Time
+	lastDecrease       time.Time
+	shed               map[string]uint64
+}
+
+// concurrencyWaiter is a queued request, ready is closed once it got a slot
+type concurrencyWaiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+func newConcurrencyLimiter(config *ConcurrencyConfig, logger *zap.Logger) *concurrencyLimiter {
+	return &concurrencyLimiter{
+		config:      config,
+		logger:      logger.With(zap.String("tag", "Concurrency")),
+		limit:       float64(config.InitialLimit),
+		windowStart: time.Now(),
+		shed:        make(map[string]uint64),
+	}
+}
+
+// Acquire waits for a slot, it returns an overloadedError if the queue is full or the slot did not free up in time.
+// The slot must be given back with Release.
+func (l *concurrencyLimiter) Acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	if l.inflight < int(l.limit) && l.queue.Len() == 0 {
+		l.inflight++
+		l.mu.Unlock()
+		return nil
+	}
+	if l.queue.Len() >= l.config.QueueSize {
+		l.shed["queue_full"]++
+		l.mu.Unlock()
+		return &overloadedError{reason: "queue_full", retryAfter: l.config.maxWait}
+	}
+	w := &concurrencyWaiter{ready: make(chan struct{})}
+	element := l.queue.PushBack(w)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.config.maxWait)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-w.ready:
+		return nil
+	case <-timer.C:
+		err = &overloadedError{reason: "timeout", retryAfter: l.config.maxWait}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if w.granted {
+		// the slot was granted while giving up
+		return nil
+	}
+	l.queue.Remove(element)
+	if _, ok := err.(*overloadedError); ok {
+		l.shed["timeout"]++
+	}
+	return err
+}
+
+// Release gives a slot back
+func (l *concurrencyLimiter) Release() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.inflight--
+	l.grant()
+	l.mu.Unlock()
+}
+
+// grant hands free slots to the queued requests, l.mu must be held
+func (l *concurrencyLimiter) grant() {
+	for l.inflight < int(l.limit) && l.queue.Len() > 0 {
+		w := l.queue.Remove(l.queue.Front()).(*concurrencyWaiter)
+		w.granted = true
+		l.inflight++
+		close(w.ready)
+	}
+}
+
+// Observe adapts the limit to the latency of a request to the Talon API, failed requests decrease it
+func (l *concurrencyLimiter) Observe(latency time.Duration, failed bool) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.windowStart) >= l.config.window {
+		l.previousMinLatency = l.minLatency
+		l.minLatency = 0
+		l.windowStart = now
+	}
+	if !failed && (l.minLatency <= 0 || latency < l.minLatency) {
+		l.minLatency = latency
+	}
+	baseline := l.minLatency
+	if l.previousMinLatency > 0 && l.previousMinLatency < baseline {
+		baseline = l.previousMinLatency
+	}
+
+	if failed || time.Duration(float64(baseline)*l.config.Tolerance) < latency {
+		// the requests that were in flight together report the same congestion, decrease once per baseline latency
+		if now.Sub(l.lastDecrease) < baseline {
+			return
+		}
+		limit := math.Max(float64(l.config.MinLimit), l.limit*l.config.Backoff)
+		if int(limit) < int(l.limit) {
+			l.logger.Debug("Decreasing concurrency limit", zap.Int("limit", int(limit)), zap.Duration("latency", latency), zap.Duration("baseline", baseline), zap.Bool("failed", failed))
+		}
+		l.limit = limit
+		l.lastDecrease = now
+		return
+	}
+	// only grow the limit if it is used
+	if l.inflight*2 >= int(l.limit) {
+		l.limit = math.Min(float64(l.config.MaxLimit), l.limit+1/l.limit)
+		l.grant()
+	}
+}
+
+// concurrencyState is a snapshot of the concurrency limiter
+type concurrencyState struct {
+	Limit    int
+	InFlight int
+	Queued   int
+	// Shed counts the shed requests by reason
+	Shed map[string]uint64
+}
+
+// State returns a snapshot of the limiter
+func (l *concurrencyLimiter) State() concurrencyState {
+	if l == nil {
+		return concurrencyState{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	shed := make(map[string]uint64, len(l.shed))
+	for reason, n := range l.shed {
+		shed[reason] = n
+	}
+	return concurrencyState{
+		Limit:    int(l.limit),
+		InFlight: l.inflight,
+		Queued:   l.queue.Len(),
+		Shed:     shed,
+	}
+}
+
+// limitedHTTPRequest sends r once a slot of the concurrency limiter is free, the slot is held until the response body is closed
+func (t *Tap) limitedHTTPRequest(r *http.Request) (*http.Response, error) {
+	if err := t.limiter.Acquire(r.Context()); err != nil {
+		return nil, err
+	}
+	held := true
+	defer func() {
+		// also release the slot if doHTTPRequest panics
+		if held {
+			t.limiter.Release()
+		}
+	}()
+	res, err := t.doHTTPRequest(r)
+	if err != nil || t.limiter == nil || res.Body == nil {
+		return res, err
+	}
+	res.Body = &limitedBody{ReadCloser: res.Body, release: t.limiter.Release}
+	held = false
+	return res, nil
+}
+
+// limitedBody releases the slot of a request once it is closed
+type limitedBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *limitedBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
@@ -0,0 +1,128 @@
+package talon_access_proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	config := &ConcurrencyConfig{InitialLimit: 2, QueueSize: 1, MaxWait: "50ms"}
+	require.NoError(t, config.setDefaults())
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	l := newConcurrencyLimiter(config, logger)
+	ctx := context.Background()
+
+	require.NoError(t, l.Acquire(ctx))
+	require.NoError(t, l.Acquire(ctx))
+
+	t.Run("Queue", func(t *testing.T) {
+		acquired := make(chan error)
+		go func() {
+			acquired <- l.Acquire(ctx)
+		}()
+		for i := 0; i < 100 && l.State().Queued < 1; i++ {
+			time.Sleep(time.Millisecond)
+		}
+
+		err := l.Acquire(ctx)
+		require.Equal(t, &overloadedError{reason: "queue_full", retryAfter: 50 * time.Millisecond}, err)
+
+		// the queued request gets the released slot
+		l.Release()
+		require.NoError(t, <-acquired)
+		require.Equal(t, 2, l.State().InFlight)
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		err := l.Acquire(ctx)
+		require.Equal(t, &overloadedError{reason: "timeout", retryAfter: 50 * time.Millisecond}, err)
+		state := l.State()
+		require.Equal(t, 0, state.Queued)
+		require.Equal(t, map[string]uint64{"queue_full": 1, "timeout": 1}, state.Shed)
+	})
+
+	t.Run("Canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		require.Equal(t, context.Canceled, l.Acquire(ctx))
+	})
+
+	t.Run("Adapt", func(t *testing.T) {
+		// low latency grows the limit by one per limit requests
+		l.Observe(10*time.Millisecond, false)
+		l.Observe(10*time.Millisecond, false)
+		require.Equal(t, 2.0+1.0/2+1.0/2.5, l.limit)
+		require.Equal(t, 2, l.State().Limit)
+		l.Observe(12*time.Millisecond, false)
+		require.Equal(t, 3, l.State().Limit)
+
+		// high latency and failures shrink it, once per baseline latency
+		l.Observe(50*time.Millisecond, false)
+		require.Equal(t, 2, l.State().Limit)
+		l.Observe(50*time.Millisecond, true)
+		require.Equal(t, 2, l.State().Limit)
+		for i := 0; i < 20; i++ {
+			l.lastDecrease = time.Time{}
+			l.Observe(0, true)
+		}
+		require.Equal(t, config.MinLimit, l.State().Limit)
+	})
+}
+
+func TestConcurrency(t *testing.T) {
+	block := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer server.Close()
+
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	tap, err := New(Config{
+		TalonAPI: server.URL,
+		Logger:   logger,
+		Metrics:  &MetricsConfig{},
+		Concurrency: &ConcurrencyConfig{
+			InitialLimit: 1,
+			MaxLimit:     1,
+			QueueSize:    -1,
+		},
+	})
+	require.NoError(t, err)
+	defer tap.Close()
+
+	done := make(chan int)
+	go func() {
+		w := httptest.NewRecorder()
+		tap.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/campaigns", nil))
+		done <- w.Code
+	}()
+	for i := 0; i < 100 && tap.limiter.State().InFlight < 1; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	w := httptest.NewRecorder()
+	tap.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/campaigns", nil))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.Equal(t, "overloaded", w.Header().Get("X-TAP-Error"))
+	require.Equal(t, "1", w.Header().Get("Retry-After"))
+
+	w = httptest.NewRecorder()
+	tap.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	metrics := w.Body.String()
+	require.Contains(t, metrics, "tap_concurrency_limit 1\n")
+	require.Contains(t, metrics, "tap_concurrency_in_flight 1\n")
+	require.Contains(t, metrics, `tap_concurrency_shed_total{reason="queue_full"} 1`)
+
+	close(block)
+	require.Equal(t, http.StatusOK, <-done)
+	// the slot is released once the response was copied
+	require.Equal(t, 0, tap.limiter.State().InFlight)
+}
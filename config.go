@@ -4,7 +4,12 @@ import (
 	"encoding/hex"
 	"errors"
 	"fmt"
+	"math"
+	"mime"
+	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/asaskevich/govalidator"
 	"go.uber.org/zap"
@@ -15,38 +20,411 @@ type Config struct {
 	// TalonAPI is the URL to use
 	TalonAPI    string
 	talonAPIUrl url.URL
+	// FailoverTalonAPI are backup URLs, used in order when TalonAPI is unavailable
+	FailoverTalonAPI []string
+	upstreams        []url.URL
+	// Failover settings
+	Failover FailoverConfig
+	// Retry settings
+	Retry RetryConfig
+	// Timeout settings
+	Timeout TimeoutConfig
+	// CircuitBreaker settings, nil disables the circuit breaker
+	CircuitBreaker *CircuitBreakerConfig
+	// Concurrency settings, nil does not limit the requests in flight
+	Concurrency *ConcurrencyConfig
+	// Throttle settings, nil passes 429 responses of the Talon API through without throttling
+	Throttle *ThrottleConfig
+	// Cache settings, nil disables the response cache
+	Cache *CacheConfig
+	// Coalesce settings, nil disables request coalescing
+	Coalesce *CoalesceConfig
+	// Forwarding settings for the X-Forwarded-For, Forwarded and Via headers
+	Forwarding ForwardingConfig
+	// Metrics settings, nil disables the Prometheus metrics
+	Metrics *MetricsConfig
+	// StatsD settings, nil disables sending metrics to StatsD
+	StatsD *StatsDConfig
+	// Tracing settings, nil disables tracing, incoming trace headers are forwarded unchanged in that case
+	Tracing *TracingConfig
+	// AccessLog settings, nil disables the access log
+	AccessLog *AccessLogConfig
+	// Redaction settings for the debug logs
+	Redaction RedactionConfig
+	// Debug settings, nil disables capturing single requests with the X-TAP-Debug header
+	Debug *DebugConfig
+	// Timing settings for the latency breakdown of requests
+	Timing TimingConfig
 	// DNSServer to use for dns lookups (Default is 8.8.8.8:53)
 	DNSServer string
 	// MaxConnections to use
 	MaxConnections int
+	// BodyMemoryLimit is the maximum size of a request body that is kept in memory when calculating the HMAC,
+	// larger bodies are spooled to a temporary file (Default is 1 MiB)
+	BodyMemoryLimit int64
 
 	// Application ID
 	Application map[string]*ApplicationConfig
+	// ApplicationHeader is the header clients can use to select an application (Default is X-TAP-Application)
+	ApplicationHeader string
+	// RequestIDHeader carries the request id, an inbound id is reused, forwarded upstream and echoed in the response (Default is X-Request-ID)
+	RequestIDHeader string
+
+	// Management API settings
+	Management *ManagementConfig
 
 	// Logger to write data to
 	Logger *zap.Logger
 }
 
+// FailoverConfig contains settings that decide when an upstream is considered down
+type FailoverConfig struct {
+	// FailureThreshold is the number of consecutive connection failures after which an upstream is down (Default is 3)
+	FailureThreshold int
+	// ErrorRate is the ratio of 5xx responses in the Window after which an upstream is down (Default is 0.5)
+	ErrorRate float64
+	// Window is the number of recent responses used to calculate the ErrorRate (Default is 20)
+	Window int
+	// MinRequests is the number of responses needed before the ErrorRate is evaluated (Default is 10)
+	MinRequests int
+	// Cooldown is the duration an upstream stays down before it is tried again (Default is 30s)
+	Cooldown string
+	cooldown time.Duration
+}
+
+// RetryConfig contains the retry policies and the retry budget
+type RetryConfig struct {
+	// Policies decide which requests are retried, the first matching policy is used.
+	// If no policies are set GET, HEAD and OPTIONS requests are retried.
+	Policies []RetryPolicy
+	// Budget is the ratio of retries to requests that is allowed (Default is 0.2)
+	Budget float64
+	// BudgetBurst is the amount of retries that is allowed without any requests (Default is 10)
+	BudgetBurst int
+}
+
+// RetryPolicy describes how requests are retried, connection errors are always retried
+type RetryPolicy struct {
+	// Methods the policy applies to, empty applies to all methods
+	Methods []string
+	// Path the policy applies to (e.g. /v2/customer_sessions/*), empty applies to all paths
+	Path string
+	// MaxAttempts including the first attempt, 1 disables retries (Default is 3)
+	MaxAttempts int
+	// RetryStatus are the status codes that are retried (Default is 502, 503 and 504)
+	RetryStatus []int
+	// InitialBackoff is the backoff before the first retry, it is doubled for every further retry (Default is 50ms)
+	InitialBackoff string
+	initialBackoff time.Duration
+	// MaxBackoff is the maximum backoff (Default is 1s)
+	MaxBackoff string
+	maxBackoff time.Duration
+}
+
+// TimeoutConfig contains the timeouts for requests to the Talon API,
+// clients can lower the total timeout with the X-TAP-Timeout header
+type TimeoutConfig struct {
+	// Total is the maximum duration of a request, including retries and the response body (Default is no timeout)
+	Total string
+	total time.Duration
+	// FirstByte is the maximum duration an upstream may take to send the response headers (Default is no timeout)
+	FirstByte string
+	firstByte time.Duration
+	// Routes override the timeouts for matching paths, the first matching route is used
+	Routes []TimeoutRoute
+}
+
+// TimeoutRoute overrides the timeouts for a path, empty timeouts are inherited
+type TimeoutRoute struct {
+	// Path the timeouts apply to (e.g. /v2/customer_sessions/*)
+	Path      string
+	Total     string
+	total     time.Duration
+	FirstByte string
+	firstByte time.Duration
+}
+
+// CircuitBreakerConfig contains the thresholds of the circuit breakers
+type CircuitBreakerConfig struct {
+	// PerApplication uses a separate circuit breaker for every application on every upstream
+	PerApplication bool
+	// ErrorRate is the ratio of failed requests in the Window that opens the circuit (Default is 0.5)
+	ErrorRate float64
+	// SlowThreshold is the latency above which a request counts as failed, empty disables it
+	SlowThreshold string
+	slowThreshold time.Duration
+	// Window is the number of recent requests used to calculate the ErrorRate (Default is 20)
+	Window int
+	// MinRequests is the number of requests needed before the ErrorRate is evaluated (Default is 10)
+	MinRequests int
+	// OpenDuration is the duration the circuit stays open before probing the upstream (Default is 30s)
+	OpenDuration string
+	openDuration time.Duration
+	// HalfOpenRequests is the number of probe requests that must succeed to close the circuit (Default is 1)
+	HalfOpenRequests int
+}
+
+// CacheConfig contains the settings of the response cache, responses with Set-Cookie, Cache-Control: private
+// or Vary: * are never stored, one variant per request is kept for the headers listed in Vary
+type CacheConfig struct {
+	// MaxEntries is the maximum number of cached responses (Default is 1000)
+	MaxEntries int
+	// MaxEntrySize is the maximum size of a cached response body in bytes (Default is 1 MiB)
+	MaxEntrySize int64
+	// Rules decide which GET requests are cached, the first matching rule is used
+	Rules []CacheRule
+}
+
+// CacheRule describes how long responses for a path are cached
+type CacheRule struct {
+	// Path the rule applies to (e.g. /v1/applications/*/campaigns)
+	Path string
+	// TTL is the duration a response is cached, a lower max-age of the response takes precedence
+	TTL string
+	ttl time.Duration
+}
+
+// ConcurrencyConfig contains the settings for the adaptive concurrency limit.
+// The limit grows while the latency of the Talon API stays low and shrinks when it rises or requests fail,
+// requests above the limit are queued and shed with 503 Service Unavailable if no slot frees up in time.
+type ConcurrencyConfig struct {
+	// InitialLimit is the number of requests in flight at start (Default is 20)
+	InitialLimit int
+	// MinLimit is the lowest limit (Default is 1)
+	MinLimit int
+	// MaxLimit is the highest limit (Default is 1000)
+	MaxLimit int
+	// Tolerance is the factor the latency may exceed the lowest latency of the last Window by before the limit shrinks (Default is 2)
+	Tolerance float64
+	// Backoff is the factor the limit is multiplied with when it shrinks (Default is 0.9)
+	Backoff float64
+	// Window is the duration the lowest latency is tracked over (Default is 30s)
+	Window string
+	window time.Duration
+	// QueueSize is the number of requests that can wait for a slot (Default is 100, -1 sheds requests right away)
+	QueueSize int
+	// MaxWait is the longest a request waits for a slot, it is also sent as Retry-After (Default is 1s)
+	MaxWait string
+	maxWait time.Duration
+}
+
+// ThrottleConfig contains the settings for throttling endpoints that the Talon API answered with 429 Too Many Requests.
+// No requests are sent to the endpoint of an application until the Retry-After passed, afterwards its rate is limited
+// and increased again while there are no more 429 responses.
+type ThrottleConfig struct {
+	// MaxWait is the longest a request is queued before it is rejected with 429 (Default is 0, requests are rejected right away)
+	MaxWait string
+	maxWait time.Duration
+	// DefaultRetryAfter is the cool-down of 429 responses without a Retry-After header (Default is 1s)
+	DefaultRetryAfter string
+	defaultRetryAfter time.Duration
+	// Decrease is the factor the rate of an endpoint is multiplied with on every 429 (Default is 0.5)
+	Decrease float64
+	// Increase is the ratio the rate grows by every second without 429 (Default is 0.1)
+	Increase float64
+	// MinRate is the lowest rate in requests per second (Default is 1)
+	MinRate float64
+	// Reset is the duration without 429 after which an endpoint is no longer throttled (Default is 1m)
+	Reset string
+	reset time.Duration
+}
+
+// CoalesceConfig contains the settings for request coalescing, identical concurrent
+// GET requests are sent upstream once and the response is shared with all clients
+type CoalesceConfig struct {
+	// Paths that are coalesced (e.g. /v1/customer_profiles/*), empty coalesces all GET requests
+	Paths []string
+}
+
+// ForwardingConfig decides which proxy headers are added to requests
+type ForwardingConfig struct {
+	// XForwardedFor appends the client address to the X-Forwarded-For header
+	XForwardedFor bool
+	// Forwarded appends the client address, protocol and host to the Forwarded header (RFC 7239)
+	Forwarded bool
+	// Via appends this proxy to the Via header of requests and responses
+	Via bool
+	// Name identifies this proxy in the Via header, it is also used to detect loops (Default is talon-access-proxy)
+	Name string
+}
+
+// MetricsConfig contains the settings for the Prometheus metrics endpoint
+type MetricsConfig struct {
+	// Path the metrics are served on (Default is /metrics)
+	Path string
+	// Address of a separate listener for the metrics (e.g. 127.0.0.1:9100), if empty they are served by the proxy
+	Address string
+}
+
+// StatsDConfig contains the settings for sending metrics to a StatsD or DogStatsD agent,
+// the metrics are the same as the Prometheus metrics
+type StatsDConfig struct {
+	// Address of the agent (e.g. 127.0.0.1:8125)
+	Address string
+	// Prefix of all metric names (Default is tap.)
+	Prefix string
+	// Tags sends the labels (e.g. application, path and status) as DogStatsD tags
+	Tags bool
+	// GlobalTags are added to all metrics if Tags is enabled (e.g. env:production)
+	GlobalTags []string
+	// FlushInterval is the interval aggregated metrics are sent in (Default is 10s)
+	FlushInterval string
+	flushInterval time.Duration
+	// MaxPacketSize is the maximum size of an UDP packet (Default is 1432)
+	MaxPacketSize int
+}
+
+// TracingConfig contains the settings for exporting spans to an OpenTelemetry collector
+type TracingConfig struct {
+	// Endpoint is the OTLP/HTTP traces endpoint of the collector (e.g. http://127.0.0.1:4318/v1/traces)
+	Endpoint string
+	// Headers are sent with every export (e.g. an API key of the tracing vendor)
+	Headers map[string]string
+	// ServiceName is the service.name of the spans (Default is talon-access-proxy)
+	ServiceName string
+	// SampleRate is the fraction of traces that are recorded, between 0 and 1 (Default is 1).
+	// Requests with a traceparent header follow the sampling decision of the caller.
+	SampleRate *float64
+	// FlushInterval is the interval spans are exported in (Default is 5s)
+	FlushInterval string
+	flushInterval time.Duration
+	// MaxBatchSize is the maximum number of spans per export (Default is 512)
+	MaxBatchSize int
+	// MaxQueueSize is the maximum number of spans waiting for an export, further spans are dropped (Default is 2048)
+	MaxQueueSize int
+}
+
+// AccessLogConfig contains the settings for the access log
+type AccessLogConfig struct {
+	// Format of the lines, common, combined or json (Default is combined)
+	Format string
+	// Path of the log file, empty or - writes to stdout
+	Path string
+	// MaxSize is the size in bytes after which the file is rotated, 0 disables size based rotation
+	MaxSize int64
+	// MaxAge is the duration after which the file is rotated (e.g. 24h), empty disables time based rotation
+	MaxAge string
+	maxAge time.Duration
+	// MaxBackups is the number of rotated files that are kept, 0 keeps all
+	MaxBackups int
+}
+
+// RedactionConfig controls which credentials and personal data are masked in the debug logs
+type RedactionConfig struct {
+	// Headers whose values are masked, in addition to Api-Key, Authorization, Proxy-Authorization,
+	// Content-Signature, Cookie, Set-Cookie and X-TAP-Debug
+	Headers []string
+	headers map[string]bool
+	// BodyFields are paths of JSON fields whose values are masked (e.g. profileId or attributes.email),
+	// a path matches at any depth, arrays are traversed and * matches any key.
+	// If set, bodies that are not JSON are not logged.
+	BodyFields []string
+	fields     [][]string
+	// MaxBodySize is the number of body bytes that are logged (Default is 4096), -1 disables logging bodies
+	MaxBodySize int
+}
+
+// DebugConfig contains the settings for capturing single requests, a request that carries the Secret in the
+// X-TAP-Debug header is logged at debug level including the bodies, the HMAC and the timing of the upstream requests
+type DebugConfig struct {
+	// Secret clients send in the X-TAP-Debug header, it must be at least 16 characters long
+	Secret string
+	// Response returns the capture in the X-TAP-Debug-Capture response header, it is always written to the log
+	Response bool
+	// MaxCaptureSize is the number of body bytes that are buffered for the redaction (Default is 1048576),
+	// bodies are cut at Redaction.MaxBodySize after the BodyFields were masked
+	MaxCaptureSize int
+}
+
+// TimingConfig contains the settings for the latency breakdown of requests into DNS, connect, TLS, wait and transfer
+type TimingConfig struct {
+	// ServerTiming adds the phases to the responses in a Server-Timing header
+	ServerTiming bool
+	// SlowThreshold logs requests that take longer with their phases (e.g. 500ms), empty disables the slow request log
+	SlowThreshold string
+	slowThreshold time.Duration
+}
+
+// ManagementConfig contains the credentials for the Management API, either Key or Email and Password must be set
+type ManagementConfig struct {
+	// PathPrefix selects Management API requests, the prefix is stripped before forwarding (Default is /management)
+	PathPrefix string
+	// Key is a management key, it is sent as `Authorization: ManagementKey-v1 <Key>`
+	Key string
+	// Email to login with
+	Email string
+	// Password to login with
+	Password string
+	// SessionLifetime is the duration a session token is used before logging in again (Default is 1h)
+	SessionLifetime string
+	sessionLifetime time.Duration
+	// LoginTimeout is the duration a login may take, requests wait for it (Default is 10s)
+	LoginTimeout string
+	loginTimeout time.Duration
+}
+
+// ApplicationConfig contains settings for a specific application
 type ApplicationConfig struct {
 	// Calculate HMAC
 	CalculateHMAC bool
 	// Application Key
 	ApplicationKey      string
 	applicationKeyBytes []byte
+	// SignatureAlgorithm to use for the HMAC, md5 or sha256 (Default is md5)
+	SignatureAlgorithm string
+	// SignContentTypes are the media types of the bodies that should be signed (Default is application/json)
+	SignContentTypes []string
+	signer           *signer
+	// VerifyInboundSignature rejects requests whose Content-Signature does not match the body
+	VerifyInboundSignature bool
+	// InboundApplicationKey is the key clients sign their requests with (required for VerifyInboundSignature)
+	InboundApplicationKey      string
+	inboundApplicationKeyBytes []byte
+	inboundSigner              *signer
 	// ApplicationToken to use
 	ApplicationToken string
+	// APIKey is the Integration API v2 key, it is sent as `Authorization: ApiKey-v1 <APIKey>`
+	APIKey string
+	// PathPrefix selects this application for requests with this path prefix, the prefix is stripped before forwarding
+	PathPrefix string
+	// Host selects this application for requests to this host
+	Host string
+	// RateLimits are token bucket limits for the requests of this application, all of them must pass
+	RateLimits []RateLimit
+}
+
+// RateLimit is a token bucket limit, requests that exceed it are rejected with 429 Too Many Requests
+type RateLimit struct {
+	// Key selects the bucket of a request: application, ip (the client IP) or body:<field> (a JSON body field, e.g. body:profileId or body:payload.customerId).
+	// Requests without the body field are not limited.
+	Key  string
+	path []string
+	// Rate is the number of requests per second
+	Rate float64
+	// Burst is the number of requests that can be sent at once (Default is Rate, at least 1)
+	Burst int
+	// Path limits only the requests that match this route pattern (Default is all requests)
+	Path string
 }
 
 // SetDefaults validates and sets defaults for Config
 func (config *Config) SetDefaults() error {
-	u, err := url.Parse(config.TalonAPI)
+	var err error
+	config.talonAPIUrl, err = parseTalonAPI(config.TalonAPI)
 	if err != nil {
 		return fmt.Errorf("Unable to parse TalonAPI: %s", err.Error())
 	}
-	config.talonAPIUrl = *u
+	config.upstreams = []url.URL{config.talonAPIUrl}
+	for _, api := range config.FailoverTalonAPI {
+		u, err := parseTalonAPI(api)
+		if err != nil {
+			return fmt.Errorf("Unable to parse FailoverTalonAPI: %s", err.Error())
+		}
+		config.upstreams = append(config.upstreams, u)
+	}
 
-	if len(config.talonAPIUrl.Scheme) <= 0 {
-		config.talonAPIUrl.Scheme = "https"
+	if err := config.Failover.setDefaults(); err != nil {
+		return err
 	}
 
 	if len(config.DNSServer) <= 0 {
@@ -57,12 +435,190 @@ func (config *Config) SetDefaults() error {
 		config.MaxConnections = 0
 	}
 
+	if config.BodyMemoryLimit <= 0 {
+		config.BodyMemoryLimit = 1 << 20
+	}
+
+	if len(config.ApplicationHeader) <= 0 {
+		config.ApplicationHeader = "X-TAP-Application"
+	}
+
+	if len(config.RequestIDHeader) <= 0 {
+		config.RequestIDHeader = "X-Request-ID"
+	}
+
+	if err := config.Retry.setDefaults(); err != nil {
+		return err
+	}
+
+	if err := config.Timeout.setDefaults(); err != nil {
+		return err
+	}
+
+	if config.CircuitBreaker != nil {
+		if err := config.CircuitBreaker.setDefaults(); err != nil {
+			return err
+		}
+	}
+
+	if config.Concurrency != nil {
+		if err := config.Concurrency.setDefaults(); err != nil {
+			return err
+		}
+	}
+
+	if config.Throttle != nil {
+		if err := config.Throttle.setDefaults(); err != nil {
+			return err
+		}
+	}
+
+	if config.Cache != nil {
+		if err := config.Cache.setDefaults(); err != nil {
+			return err
+		}
+	}
+
+	if config.Coalesce != nil {
+		for i, p := range config.Coalesce.Paths {
+			if !validRoute(p) {
+				return fmt.Errorf("Coalesce.Paths[%d] is invalid", i)
+			}
+		}
+	}
+
+	if len(config.Forwarding.Name) <= 0 {
+		config.Forwarding.Name = "talon-access-proxy"
+	}
+	if strings.ContainsAny(config.Forwarding.Name, " \t,") {
+		return errors.New("Forwarding.Name must not contain whitespace or commas")
+	}
+
+	if config.Metrics != nil {
+		if len(config.Metrics.Path) <= 0 {
+			config.Metrics.Path = "/metrics"
+		}
+		config.Metrics.Path = "/" + strings.Trim(config.Metrics.Path, "/")
+		if len(config.Metrics.Address) > 0 && !govalidator.IsDialString(config.Metrics.Address) {
+			return errors.New("Metrics.Address is invalid, must be in the form of host:port")
+		}
+	}
+
+	if config.StatsD != nil {
+		if !govalidator.IsDialString(config.StatsD.Address) {
+			return errors.New("StatsD.Address is invalid, must be in the form of host:port")
+		}
+		if len(config.StatsD.Prefix) <= 0 {
+			config.StatsD.Prefix = "tap."
+		}
+		if len(config.StatsD.FlushInterval) <= 0 {
+			config.StatsD.FlushInterval = "10s"
+		}
+		config.StatsD.flushInterval, err = time.ParseDuration(config.StatsD.FlushInterval)
+		if err != nil {
+			return fmt.Errorf("Unable to parse StatsD.FlushInterval: %s", err.Error())
+		}
+		if config.StatsD.flushInterval <= 0 {
+			return errors.New("StatsD.FlushInterval must be positive")
+		}
+		if config.StatsD.MaxPacketSize <= 0 {
+			config.StatsD.MaxPacketSize = 1432
+		}
+	}
+
+	if config.Tracing != nil {
+		if err := config.Tracing.setDefaults(); err != nil {
+			return err
+		}
+	}
+
+	config.Redaction.setDefaults()
+
+	if config.Timing.slowThreshold, err = parseTimeout(config.Timing.SlowThreshold); err != nil {
+		return fmt.Errorf("Unable to parse Timing.SlowThreshold: %s", err.Error())
+	}
+
+	if config.Debug != nil {
+		if err := config.Debug.setDefaults(config.Redaction.MaxBodySize); err != nil {
+			return err
+		}
+	}
+
+	if config.AccessLog != nil {
+		if err := config.AccessLog.setDefaults(); err != nil {
+			return err
+		}
+	}
+
+	if config.Management != nil {
+		if len(config.Management.PathPrefix) <= 0 {
+			config.Management.PathPrefix = "/management"
+		}
+		config.Management.PathPrefix = "/" + strings.Trim(config.Management.PathPrefix, "/")
+
+		if len(config.Management.SessionLifetime) <= 0 {
+			config.Management.SessionLifetime = "1h"
+		}
+		config.Management.sessionLifetime, err = time.ParseDuration(config.Management.SessionLifetime)
+		if err != nil {
+			return fmt.Errorf("Unable to parse Management.SessionLifetime: %s", err.Error())
+		}
+
+		if len(config.Management.LoginTimeout) <= 0 {
+			config.Management.LoginTimeout = "10s"
+		}
+		config.Management.loginTimeout, err = time.ParseDuration(config.Management.LoginTimeout)
+		if err != nil {
+			return fmt.Errorf("Unable to parse Management.LoginTimeout: %s", err.Error())
+		}
+	}
+
 	for id, key := range config.Application {
 		var err error
 		config.Application[id].applicationKeyBytes, err = hex.DecodeString(key.ApplicationKey)
 		if err != nil {
 			return fmt.Errorf("ApplicationKey is invalid, (ApplicationID=%s)", id)
 		}
+
+		if len(key.SignatureAlgorithm) <= 0 {
+			key.SignatureAlgorithm = "md5"
+		}
+		key.SignatureAlgorithm = strings.ToLower(key.SignatureAlgorithm)
+		if _, ok := signatureAlgorithms[key.SignatureAlgorithm]; !ok {
+			return fmt.Errorf("SignatureAlgorithm `%s' is not supported, (ApplicationID=%s)", key.SignatureAlgorithm, id)
+		}
+
+		if len(key.SignContentTypes) <= 0 {
+			key.SignContentTypes = []string{"application/json"}
+		}
+		for i, contentType := range key.SignContentTypes {
+			key.SignContentTypes[i], _, err = mime.ParseMediaType(contentType)
+			if err != nil {
+				return fmt.Errorf("SignContentTypes contains an invalid media type `%s', (ApplicationID=%s)", contentType, id)
+			}
+		}
+
+		if len(key.applicationKeyBytes) > 0 {
+			key.signer = newSigner(key.SignatureAlgorithm, key.applicationKeyBytes)
+		}
+
+		if len(key.PathPrefix) > 0 {
+			key.PathPrefix = "/" + strings.Trim(key.PathPrefix, "/")
+		}
+
+		key.inboundApplicationKeyBytes, err = hex.DecodeString(key.InboundApplicationKey)
+		if err != nil {
+			return fmt.Errorf("InboundApplicationKey is invalid, (ApplicationID=%s)", id)
+		}
+		if len(key.inboundApplicationKeyBytes) > 0 {
+			key.inboundSigner = newSigner(key.SignatureAlgorithm, key.inboundApplicationKeyBytes)
+		}
+
+		for i := range key.RateLimits {
+			if err := key.RateLimits[i].setDefaults(); err != nil {
+				return fmt.Errorf("%s, (ApplicationID=%s)", err.Error(), id)
+			}
+		}
 	}
 
 	if err := config.createLogger(); err != nil {
@@ -72,6 +628,373 @@ func (config *Config) SetDefaults() error {
 	return config.testConfig()
 }
 
+func parseTalonAPI(api string) (url.URL, error) {
+	u, err := url.Parse(api)
+	if err != nil {
+		return url.URL{}, err
+	}
+	if len(u.Scheme) <= 0 {
+		u.Scheme = "https"
+	}
+	return *u, nil
+}
+
+func (config *FailoverConfig) setDefaults() error {
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = 3
+	}
+	if config.ErrorRate <= 0 {
+		config.ErrorRate = 0.5
+	}
+	if config.Window <= 0 {
+		config.Window = 20
+	}
+	if config.MinRequests <= 0 {
+		config.MinRequests = 10
+	}
+	if config.MinRequests > config.Window {
+		config.MinRequests = config.Window
+	}
+	if len(config.Cooldown) <= 0 {
+		config.Cooldown = "30s"
+	}
+	var err error
+	config.cooldown, err = time.ParseDuration(config.Cooldown)
+	if err != nil {
+		return fmt.Errorf("Unable to parse Failover.Cooldown: %s", err.Error())
+	}
+	return nil
+}
+
+func (config *RetryConfig) setDefaults() error {
+	if config.Policies == nil {
+		config.Policies = []RetryPolicy{
+			{Methods: []string{http.MethodGet, http.MethodHead, http.MethodOptions}},
+		}
+	}
+	if config.Budget <= 0 {
+		config.Budget = 0.2
+	}
+	if config.BudgetBurst <= 0 {
+		config.BudgetBurst = 10
+	}
+	for i := range config.Policies {
+		policy := &config.Policies[i]
+		if !validRoute(policy.Path) {
+			return fmt.Errorf("Retry.Policies[%d].Path is invalid", i)
+		}
+		if policy.MaxAttempts <= 0 {
+			policy.MaxAttempts = 3
+		}
+		if len(policy.RetryStatus) <= 0 {
+			policy.RetryStatus = []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+		}
+		if len(policy.InitialBackoff) <= 0 {
+			policy.InitialBackoff = "50ms"
+		}
+		if len(policy.MaxBackoff) <= 0 {
+			policy.MaxBackoff = "1s"
+		}
+		var err error
+		policy.initialBackoff, err = time.ParseDuration(policy.InitialBackoff)
+		if err != nil {
+			return fmt.Errorf("Unable to parse Retry.Policies[%d].InitialBackoff: %s", i, err.Error())
+		}
+		policy.maxBackoff, err = time.ParseDuration(policy.MaxBackoff)
+		if err != nil {
+			return fmt.Errorf("Unable to parse Retry.Policies[%d].MaxBackoff: %s", i, err.Error())
+		}
+	}
+	return nil
+}
+
+func (config *CircuitBreakerConfig) setDefaults() error {
+	if config.ErrorRate <= 0 {
+		config.ErrorRate = 0.5
+	}
+	if config.Window <= 0 {
+		config.Window = 20
+	}
+	if config.MinRequests <= 0 {
+		config.MinRequests = 10
+	}
+	if config.MinRequests > config.Window {
+		config.MinRequests = config.Window
+	}
+	if config.HalfOpenRequests <= 0 {
+		config.HalfOpenRequests = 1
+	}
+	if len(config.OpenDuration) <= 0 {
+		config.OpenDuration = "30s"
+	}
+	var err error
+	config.openDuration, err = time.ParseDuration(config.OpenDuration)
+	if err != nil {
+		return fmt.Errorf("Unable to parse CircuitBreaker.OpenDuration: %s", err.Error())
+	}
+	if len(config.SlowThreshold) > 0 {
+		config.slowThreshold, err = time.ParseDuration(config.SlowThreshold)
+		if err != nil {
+			return fmt.Errorf("Unable to parse CircuitBreaker.SlowThreshold: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+func (config *TimeoutConfig) setDefaults() error {
+	var err error
+	if config.total, err = parseTimeout(config.Total); err != nil {
+		return fmt.Errorf("Unable to parse Timeout.Total: %s", err.Error())
+	}
+	if config.firstByte, err = parseTimeout(config.FirstByte); err != nil {
+		return fmt.Errorf("Unable to parse Timeout.FirstByte: %s", err.Error())
+	}
+	for i := range config.Routes {
+		route := &config.Routes[i]
+		if !validRoute(route.Path) {
+			return fmt.Errorf("Timeout.Routes[%d].Path is invalid", i)
+		}
+		if route.total, err = parseTimeout(route.Total); err != nil {
+			return fmt.Errorf("Unable to parse Timeout.Routes[%d].Total: %s", i, err.Error())
+		}
+		if route.firstByte, err = parseTimeout(route.FirstByte); err != nil {
+			return fmt.Errorf("Unable to parse Timeout.Routes[%d].FirstByte: %s", i, err.Error())
+		}
+	}
+	return nil
+}
+
+// parseTimeout parses an optional duration, an empty string or 0 disables the timeout
+func parseTimeout(s string) (time.Duration, error) {
+	if len(s) <= 0 {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if d < 0 {
+		return 0, errors.New("negative duration")
+	}
+	return d, nil
+}
+
+func (config *TracingConfig) setDefaults() error {
+	u, err := url.Parse(config.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) <= 0 {
+		return errors.New("Tracing.Endpoint is invalid, must be an http or https URL")
+	}
+	if len(config.ServiceName) <= 0 {
+		config.ServiceName = "talon-access-proxy"
+	}
+	if config.SampleRate == nil {
+		rate := 1.0
+		config.SampleRate = &rate
+	}
+	if *config.SampleRate < 0 || *config.SampleRate > 1 {
+		return errors.New("Tracing.SampleRate must be between 0 and 1")
+	}
+	if len(config.FlushInterval) <= 0 {
+		config.FlushInterval = "5s"
+	}
+	config.flushInterval, err = time.ParseDuration(config.FlushInterval)
+	if err != nil {
+		return fmt.Errorf("Unable to parse Tracing.FlushInterval: %s", err.Error())
+	}
+	if config.flushInterval <= 0 {
+		return errors.New("Tracing.FlushInterval must be positive")
+	}
+	if config.MaxBatchSize <= 0 {
+		config.MaxBatchSize = 512
+	}
+	if config.MaxQueueSize <= 0 {
+		config.MaxQueueSize = 2048
+	}
+	return nil
+}
+
+func (config *AccessLogConfig) setDefaults() error {
+	if len(config.Format) <= 0 {
+		config.Format = "combined"
+	}
+	config.Format = strings.ToLower(config.Format)
+	if config.Format != "common" && config.Format != "combined" && config.Format != "json" {
+		return fmt.Errorf("AccessLog.Format `%s' is not supported, use common, combined or json", config.Format)
+	}
+	if config.MaxSize < 0 {
+		return errors.New("AccessLog.MaxSize must not be negative")
+	}
+	if config.MaxBackups < 0 {
+		return errors.New("AccessLog.MaxBackups must not be negative")
+	}
+	var err error
+	if config.maxAge, err = parseTimeout(config.MaxAge); err != nil {
+		return fmt.Errorf("Unable to parse AccessLog.MaxAge: %s", err.Error())
+	}
+	return nil
+}
+
+func (config *RedactionConfig) setDefaults() {
+	if config.MaxBodySize == 0 {
+		config.MaxBodySize = 4096
+	}
+	config.headers = make(map[string]bool)
+	for _, name := range append(credentialHeaders, config.Headers...) {
+		config.headers[http.CanonicalHeaderKey(name)] = true
+	}
+	config.fields = nil
+	for _, field := range config.BodyFields {
+		if field = strings.Trim(field, "."); len(field) > 0 {
+			config.fields = append(config.fields, strings.Split(field, "."))
+		}
+	}
+}
+
+func (config *DebugConfig) setDefaults(maxBodySize int) error {
+	if len(config.Secret) < 16 {
+		return errors.New("Debug.Secret must be at least 16 characters long")
+	}
+	if config.MaxCaptureSize <= 0 {
+		config.MaxCaptureSize = 1048576
+	}
+	if config.MaxCaptureSize < maxBodySize {
+		config.MaxCaptureSize = maxBodySize
+	}
+	return nil
+}
+
+func (config *RateLimit) setDefaults() error {
+	switch {
+	case config.Key == "application" || config.Key == "ip":
+	case strings.HasPrefix(config.Key, "body:") && len(strings.Trim(config.Key[len("body:"):], ".")) > 0:
+		config.path = strings.Split(strings.Trim(config.Key[len("body:"):], "."), ".")
+	default:
+		return fmt.Errorf("RateLimits Key `%s' is invalid, use application, ip or body:<field>", config.Key)
+	}
+	if config.Rate <= 0 {
+		return errors.New("RateLimits Rate must be positive")
+	}
+	if config.Burst <= 0 {
+		config.Burst = int(math.Max(1, math.Ceil(config.Rate)))
+	}
+	if !validRoute(config.Path) {
+		return errors.New("RateLimits Path is invalid")
+	}
+	return nil
+}
+
+func (config *ConcurrencyConfig) setDefaults() error {
+	if config.MinLimit <= 0 {
+		config.MinLimit = 1
+	}
+	if config.MaxLimit <= 0 {
+		config.MaxLimit = 1000
+	}
+	if config.MaxLimit < config.MinLimit {
+		return errors.New("Concurrency.MaxLimit must not be less than MinLimit")
+	}
+	if config.InitialLimit <= 0 {
+		config.InitialLimit = 20
+	}
+	if config.InitialLimit < config.MinLimit {
+		config.InitialLimit = config.MinLimit
+	}
+	if config.InitialLimit > config.MaxLimit {
+		config.InitialLimit = config.MaxLimit
+	}
+	if config.Tolerance <= 0 {
+		config.Tolerance = 2
+	}
+	if config.Tolerance < 1 {
+		return errors.New("Concurrency.Tolerance must be at least 1")
+	}
+	if config.Backoff <= 0 {
+		config.Backoff = 0.9
+	}
+	if config.Backoff >= 1 {
+		return errors.New("Concurrency.Backoff must be less than 1")
+	}
+	if config.QueueSize < 0 {
+		config.QueueSize = 0
+	} else if config.QueueSize == 0 {
+		config.QueueSize = 100
+	}
+	if len(config.Window) <= 0 {
+		config.Window = "30s"
+	}
+	var err error
+	config.window, err = time.ParseDuration(config.Window)
+	if err != nil {
+		return fmt.Errorf("Unable to parse Concurrency.Window: %s", err.Error())
+	}
+	if len(config.MaxWait) <= 0 {
+		config.MaxWait = "1s"
+	}
+	config.maxWait, err = time.ParseDuration(config.MaxWait)
+	if err != nil {
+		return fmt.Errorf("Unable to parse Concurrency.MaxWait: %s", err.Error())
+	}
+	return nil
+}
+
+func (config *ThrottleConfig) setDefaults() error {
+	var err error
+	if len(config.MaxWait) > 0 {
+		config.maxWait, err = time.ParseDuration(config.MaxWait)
+		if err != nil {
+			return fmt.Errorf("Unable to parse Throttle.MaxWait: %s", err.Error())
+		}
+	}
+	if len(config.DefaultRetryAfter) <= 0 {
+		config.DefaultRetryAfter = "1s"
+	}
+	config.defaultRetryAfter, err = time.ParseDuration(config.DefaultRetryAfter)
+	if err != nil {
+		return fmt.Errorf("Unable to parse Throttle.DefaultRetryAfter: %s", err.Error())
+	}
+	if len(config.Reset) <= 0 {
+		config.Reset = "1m"
+	}
+	config.reset, err = time.ParseDuration(config.Reset)
+	if err != nil {
+		return fmt.Errorf("Unable to parse Throttle.Reset: %s", err.Error())
+	}
+	if config.Decrease <= 0 {
+		config.Decrease = 0.5
+	}
+	if config.Decrease >= 1 {
+		return errors.New("Throttle.Decrease must be less than 1")
+	}
+	if config.Increase <= 0 {
+		config.Increase = 0.1
+	}
+	if config.MinRate <= 0 {
+		config.MinRate = 1
+	}
+	return nil
+}
+
+func (config *CacheConfig) setDefaults() error {
+	if config.MaxEntries <= 0 {
+		config.MaxEntries = 1000
+	}
+	if config.MaxEntrySize <= 0 {
+		config.MaxEntrySize = 1 << 20
+	}
+	for i := range config.Rules {
+		rule := &config.Rules[i]
+		if !validRoute(rule.Path) {
+			return fmt.Errorf("Cache.Rules[%d].Path is invalid", i)
+		}
+		var err error
+		rule.ttl, err = time.ParseDuration(rule.TTL)
+		if err != nil {
+			return fmt.Errorf("Unable to parse Cache.Rules[%d].TTL: %s", i, err.Error())
+		}
+	}
+	return nil
+}
+
 func (config *Config) testConfig() error {
 	if len(config.TalonAPI) <= 0 {
 		return errors.New("TalonAPI is not set")
@@ -85,6 +1008,20 @@ func (config *Config) testConfig() error {
 				return errors.New("ApplicationKey must be set if you want to use the CalculateHMAC function")
 			}
 		}
+		if key.VerifyInboundSignature {
+			if len(key.inboundApplicationKeyBytes) <= 0 {
+				return errors.New("InboundApplicationKey must be set if you want to use the VerifyInboundSignature function")
+			}
+		}
+	}
+
+	if config.Management != nil {
+		if len(config.Management.Key) <= 0 && (len(config.Management.Email) <= 0 || len(config.Management.Password) <= 0) {
+			return errors.New("Management needs either a Key or an Email and Password")
+		}
+		if config.Management.PathPrefix == "/" {
+			return errors.New("Management.PathPrefix must not be /")
+		}
 	}
 
 	return nil
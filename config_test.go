@@ -54,6 +54,60 @@ func TestConfigSetDefaults(t *testing.T) {
 		}
 		require.Error(t, config.SetDefaults())
 	})
+	t.Run("Invalid SignatureAlgorithm", func(t *testing.T) {
+		config := &Config{
+			TalonAPI: "https://demo.talon.one",
+			Application: map[string]*ApplicationConfig{
+				"1": &ApplicationConfig{
+					ApplicationKey:     "deadbeef",
+					SignatureAlgorithm: "sha1",
+				},
+			},
+		}
+		require.Error(t, config.SetDefaults())
+	})
+	t.Run("VerifyInboundSignature needs InboundApplicationKey", func(t *testing.T) {
+		config := &Config{
+			TalonAPI: "https://demo.talon.one",
+			Application: map[string]*ApplicationConfig{
+				"1": &ApplicationConfig{
+					VerifyInboundSignature: true,
+				},
+			},
+		}
+		require.Error(t, config.SetDefaults())
+	})
+	t.Run("RateLimits", func(t *testing.T) {
+		newConfig := func(limit RateLimit) *Config {
+			return &Config{
+				TalonAPI: "https://demo.talon.one",
+				Application: map[string]*ApplicationConfig{
+					"1": &ApplicationConfig{RateLimits: []RateLimit{limit}},
+				},
+			}
+		}
+		config := newConfig(RateLimit{Key: "body:payload.profileId", Rate: 2.5})
+		require.NoError(t, config.SetDefaults())
+		limit := config.Application["1"].RateLimits[0]
+		require.Equal(t, 3, limit.Burst)
+		require.Equal(t, []string{"payload", "profileId"}, limit.path)
+
+		require.Error(t, newConfig(RateLimit{Key: "user", Rate: 1}).SetDefaults())
+		require.Error(t, newConfig(RateLimit{Key: "body:", Rate: 1}).SetDefaults())
+		require.Error(t, newConfig(RateLimit{Key: "ip"}).SetDefaults())
+		require.Error(t, newConfig(RateLimit{Key: "ip", Rate: 1, Path: "/v1/["}).SetDefaults())
+	})
+	t.Run("Debug Secret", func(t *testing.T) {
+		config := &Config{
+			TalonAPI: "https://demo.talon.one",
+			Debug:    &DebugConfig{},
+		}
+		require.Error(t, config.SetDefaults())
+		config.Debug.Secret = "short"
+		require.Error(t, config.SetDefaults())
+		config.Debug.Secret = "0123456789abcdef"
+		require.NoError(t, config.SetDefaults())
+	})
 	t.Run("No Scheme", func(t *testing.T) {
 		config := &Config{
 			TalonAPI: "demo.talon.one",
@@ -61,4 +115,20 @@ func TestConfigSetDefaults(t *testing.T) {
 		require.NoError(t, config.SetDefaults())
 		require.Equal(t, "https://demo.talon.one", config.talonAPIUrl.String())
 	})
+	t.Run("Tracing", func(t *testing.T) {
+		config := &Config{
+			TalonAPI: "https://demo.talon.one",
+			Tracing:  &TracingConfig{Endpoint: "http://127.0.0.1:4318/v1/traces"},
+		}
+		require.NoError(t, config.SetDefaults())
+		require.Equal(t, 1.0, *config.Tracing.SampleRate)
+		require.Equal(t, "talon-access-proxy", config.Tracing.ServiceName)
+
+		config.Tracing = &TracingConfig{Endpoint: "127.0.0.1:4318"}
+		require.Error(t, config.SetDefaults())
+
+		rate := 1.5
+		config.Tracing = &TracingConfig{Endpoint: "http://127.0.0.1:4318/v1/traces", SampleRate: &rate}
+		require.Error(t, config.SetDefaults())
+	})
 }
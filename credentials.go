@@ -0,0 +1,101 @@
+package talon_access_proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseHeaderFields parses a header in the form of `key1=value1;key2=value2`,
+// fields can be separated by `;` or `.`, keys are returned in lower case
+func parseHeaderFields(header string, separators string) map[string]string {
+	fields := make(map[string]string)
+	for _, field := range strings.FieldsFunc(header, func(r rune) bool {
+		return strings.ContainsRune(separators, r)
+	}) {
+		tokens := strings.SplitN(field, "=", 2)
+		if len(tokens) < 2 {
+			continue
+		}
+		fields[strings.ToLower(strings.TrimSpace(tokens[0]))] = strings.TrimSpace(tokens[1])
+	}
+	return fields
+}
+
+// extractApplicationID returns the application id a client sent in the
+// legacy Api-Key header or the signer field of the Content-Signature header
+func extractApplicationID(r *http.Request) string {
+	if header := r.Header.Get("Api-Key"); len(header) > 0 {
+		if id := parseHeaderFields(header, ";.")["application"]; len(id) > 0 {
+			return id
+		}
+	}
+
+	if header := r.Header.Get("Content-Signature"); len(header) > 0 {
+		if signer, _ := parseContentSignature(header); len(signer) > 0 {
+			return signer
+		}
+	}
+	return ""
+}
+
+// application returns the config for the application id
+func (config *Config) application(appID string) (string, *ApplicationConfig) {
+	if len(appID) <= 0 {
+		return "", nil
+	}
+	for id, app := range config.Application {
+		if strings.EqualFold(id, appID) {
+			return id, app
+		}
+	}
+	return "", nil
+}
+
+// resolveApplication determinates the application a request belongs to, in this order:
+// the legacy Api-Key header, the Content-Signature signer, the ApplicationHeader,
+// the longest matching PathPrefix and the Host.
+// If a PathPrefix matched it is stripped from the request url.
+func (config *Config) resolveApplication(r *http.Request) (string, *ApplicationConfig) {
+	if id, app := config.application(extractApplicationID(r)); app != nil {
+		return id, app
+	}
+
+	if id, app := config.application(r.Header.Get(config.ApplicationHeader)); app != nil {
+		return id, app
+	}
+
+	var prefixID string
+	var prefixApp *ApplicationConfig
+	for id, app := range config.Application {
+		if len(app.PathPrefix) <= 0 || !hasPathPrefix(r.URL.Path, app.PathPrefix) {
+			continue
+		}
+		if prefixApp == nil || len(app.PathPrefix) > len(prefixApp.PathPrefix) {
+			prefixID, prefixApp = id, app
+		}
+	}
+	if prefixApp != nil {
+		r.URL.Path = "/" + strings.TrimLeft(strings.TrimPrefix(r.URL.Path, prefixApp.PathPrefix), "/")
+		r.URL.RawPath = ""
+		return prefixID, prefixApp
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for id, app := range config.Application {
+		if len(app.Host) > 0 && strings.EqualFold(app.Host, host) {
+			return id, app
+		}
+	}
+	return "", nil
+}
+
+func hasPathPrefix(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || path[len(prefix)] == '/'
+}
@@ -0,0 +1,104 @@
+package talon_access_proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestExtractApplicationID(t *testing.T) {
+	tests := []struct {
+		header string
+		value  string
+		id     string
+	}{
+		{"Api-Key", "application=1.token=abc", "1"},
+		{"Api-Key", "application=2;token=abc", "2"},
+		{"Api-Key", "token=abc; application = 3", "3"},
+		{"Content-Signature", "signer=4;signature=abc", "4"},
+		{"Content-Signature", "signature=abc; signer=5", "5"},
+		{"Content-Signature", "signature", ""},
+		{"Authorization", "ApiKey-v1 abc", ""},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(test.header, test.value)
+		require.Equal(t, test.id, extractApplicationID(r), "%s: %s", test.header, test.value)
+	}
+}
+
+func TestAPIKeyInjection(t *testing.T) {
+	var gotPath, gotAuthorization, gotAPIKey, gotApplicationHeader string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotAuthorization = r.Header.Get("Authorization")
+		gotAPIKey = r.Header.Get("Api-Key")
+		gotApplicationHeader = r.Header.Get("X-TAP-Application")
+	}))
+	defer server.Close()
+
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	tap, err := New(Config{
+		TalonAPI: server.URL,
+		Logger:   logger,
+		Application: map[string]*ApplicationConfig{
+			"1": &ApplicationConfig{
+				APIKey:     "key1",
+				PathPrefix: "/shop/",
+			},
+			"2": &ApplicationConfig{
+				APIKey: "key2",
+				Host:   "app2.example.com",
+			},
+			"3": &ApplicationConfig{
+				ApplicationToken: "token3",
+				APIKey:           "key3",
+			},
+		},
+	})
+	require.NoError(t, err)
+	defer tap.Close()
+
+	send := func(r *http.Request) {
+		gotPath, gotAuthorization, gotAPIKey, gotApplicationHeader = "", "", "", ""
+		w := httptest.NewRecorder()
+		tap.Handler().ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	t.Run("PathPrefix", func(t *testing.T) {
+		send(httptest.NewRequest(http.MethodGet, "/shop/v2/customer_profiles/1", nil))
+		require.Equal(t, "/v2/customer_profiles/1", gotPath)
+		require.Equal(t, "ApiKey-v1 key1", gotAuthorization)
+	})
+	t.Run("PathPrefix must match a segment", func(t *testing.T) {
+		send(httptest.NewRequest(http.MethodGet, "/shopping/v2/customer_profiles/1", nil))
+		require.Equal(t, "/shopping/v2/customer_profiles/1", gotPath)
+		require.Empty(t, gotAuthorization)
+	})
+	t.Run("Host", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/v2/customer_profiles/1", nil)
+		r.Host = "APP2.example.com:8000"
+		send(r)
+		require.Equal(t, "ApiKey-v1 key2", gotAuthorization)
+	})
+	t.Run("ApplicationHeader", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/v2/customer_profiles/1", nil)
+		r.Header.Set("X-TAP-Application", "2")
+		send(r)
+		require.Equal(t, "ApiKey-v1 key2", gotAuthorization)
+		require.Empty(t, gotApplicationHeader)
+	})
+	t.Run("Legacy Api-Key", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/shop/v1/customer_profiles/1", nil)
+		r.Header.Set("Api-Key", "application=3")
+		send(r)
+		require.Equal(t, "/shop/v1/customer_profiles/1", gotPath)
+		require.Equal(t, "application=3.token=token3", gotAPIKey)
+		require.Equal(t, "ApiKey-v1 key3", gotAuthorization)
+	})
+}
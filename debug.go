@@ -0,0 +1,258 @@
+package talon_access_proxy
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	// debugHeader carries the secret that enables the capture of a request
+	debugHeader = "X-TAP-Debug"
+	// debugCaptureHeader returns the capture to the client
+	debugCaptureHeader = "X-TAP-Debug-Capture"
+)
+
+// debugCapture records all log lines of a single request at debug level, together with the bodies
+// and the timing of the upstream requests.
+// All methods can be called on a nil *debugCapture, in that case nothing is captured.
+type debugCapture struct {
+	redaction *RedactionConfig
+	core      zapcore.Core
+	// logger is the request logger including the capture, it is used by the httptrace hooks
+	logger *zap.Logger
+
+	mu      sync.Mutex
+	entries bytes.Buffer
+
+	requestBody  captureBuffer
+	responseBody captureBuffer
+}
+
+// startDebugCapture returns a capture if r carries the debug secret
+func (t *Tap) startDebugCapture(r *http.Request) *debugCapture {
+	if t.Config.Debug == nil {
+		return nil
+	}
+	value := r.Header.Get(debugHeader)
+	if len(value) <= 0 || subtle.ConstantTimeCompare([]byte(value), []byte(t.Config.Debug.Secret)) != 1 {
+		return nil
+	}
+	c := &debugCapture{redaction: &t.Config.Redaction}
+	if t.Config.Redaction.MaxBodySize >= 0 {
+		// the bodies are redacted before they are cut at MaxBodySize, JSON that was cut could not be parsed
+		c.requestBody.limit = t.Config.Debug.MaxCaptureSize
+		c.responseBody.limit = t.Config.Debug.MaxCaptureSize
+	}
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	c.core = zapcore.NewCore(zapcore.NewJSONEncoder(encoderConfig), zapcore.AddSync(c), zap.DebugLevel)
+	return c
+}
+
+// Write receives the encoded log lines of the capture core
+func (c *debugCapture) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries.Write(p)
+}
+
+// wrap returns logger with the capture added, debug lines are captured even if the logger is at a higher level
+func (c *debugCapture) wrap(logger *zap.Logger) *zap.Logger {
+	if c == nil {
+		return logger
+	}
+	logger = logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return zapcore.NewTee(core, c.core)
+	}))
+	c.logger = logger
+	return logger
+}
+
+// wrapBody records the request body while it is read
+func (c *debugCapture) wrapBody(body io.ReadCloser) io.ReadCloser {
+	if c == nil || body == nil || body == http.NoBody {
+		return body
+	}
+	return &captureReader{body, &c.requestBody}
+}
+
+// wrapWriter records the response body while it is written to w
+func (c *debugCapture) wrapWriter(w io.Writer) io.Writer {
+	if c == nil {
+		return w
+	}
+	return io.MultiWriter(w, &c.responseBody)
+}
+
+// lines returns the captured log lines
+func (c *debugCapture) lines() []json.RawMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var lines []json.RawMessage
+	for _, line := range bytes.Split(bytes.TrimSpace(c.entries.Bytes()), []byte("\n")) {
+		if len(line) > 0 {
+			lines = append(lines, json.RawMessage(append([]byte(nil), line...)))
+		}
+	}
+	return lines
+}
+
+// setHeader returns the lines that were captured so far in the X-TAP-Debug-Capture header,
+// it contains a base64 encoded JSON array
+func (c *debugCapture) setHeader(header http.Header, config *DebugConfig) {
+	if c == nil || !config.Response {
+		return
+	}
+	data, err := json.Marshal(c.lines())
+	if err != nil {
+		return
+	}
+	header.Set(debugCaptureHeader, base64.StdEncoding.EncodeToString(data))
+}
+
+// emit writes the capture to logger
+func (c *debugCapture) emit(logger *zap.Logger, info *requestInfo) {
+	if c == nil {
+		return
+	}
+	logger.Info("Debug capture",
+		zap.String("requestId", info.ID),
+		zap.Any("lines", c.lines()),
+		zap.Int64("requestBodySize", c.requestBody.Size()),
+		zap.String("requestBody", c.body(&c.requestBody)),
+		zap.Int64("responseBodySize", c.responseBody.Size()),
+		zap.String("responseBody", c.body(&c.responseBody)),
+	)
+}
+
+// body returns the redacted body of b, bodies that exceed MaxCaptureSize cannot be redacted
+func (c *debugCapture) body(b *captureBuffer) string {
+	data := b.Bytes()
+	if len(c.redaction.fields) > 0 && b.Size() > int64(len(data)) {
+		return "[REDACTED: body is larger than Debug.MaxCaptureSize]"
+	}
+	return c.redaction.body(data)
+}
+
+// clientTrace returns httptrace hooks that log the phases of an upstream request
+func (c *debugCapture) clientTrace() *httptrace.ClientTrace {
+	if c == nil || c.logger == nil {
+		return nil
+	}
+	logger := c.logger
+	start := time.Now()
+	// the hooks of parallel dials can be called concurrently
+	var mu sync.Mutex
+	var dnsStart, tlsStart time.Time
+	connectStart := make(map[string]time.Time)
+	return &httptrace.ClientTrace{
+		GetConn: func(hostPort string) {
+			logger.Debug("Getting connection", zap.String("hostPort", hostPort))
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			mu.Lock()
+			dnsStart = time.Now()
+			mu.Unlock()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			mu.Lock()
+			duration := time.Since(dnsStart)
+			mu.Unlock()
+			addresses := make([]string, len(info.Addrs))
+			for i, addr := range info.Addrs {
+				addresses[i] = addr.String()
+			}
+			logger.Debug("DNS lookup done", zap.Duration("duration", duration), zap.Strings("addresses", addresses), zap.Error(info.Err))
+		},
+		ConnectStart: func(network, addr string) {
+			mu.Lock()
+			connectStart[network+" "+addr] = time.Now()
+			mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mu.Lock()
+			duration := time.Since(connectStart[network+" "+addr])
+			mu.Unlock()
+			logger.Debug("Connect done", zap.String("addr", addr), zap.Duration("duration", duration), zap.Error(err))
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			tlsStart = time.Now()
+			mu.Unlock()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			mu.Lock()
+			duration := time.Since(tlsStart)
+			mu.Unlock()
+			logger.Debug("TLS handshake done", zap.Duration("duration", duration), zap.Uint16("version", state.Version), zap.Bool("resumed", state.DidResume), zap.Error(err))
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			logger.Debug("Got connection", zap.Duration("elapsed", time.Since(start)), zap.Bool("reused", info.Reused), zap.Duration("idleTime", info.IdleTime))
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			logger.Debug("Wrote request", zap.Duration("elapsed", time.Since(start)), zap.Error(info.Err))
+		},
+		GotFirstResponseByte: func() {
+			logger.Debug("Got first response byte", zap.Duration("elapsed", time.Since(start)))
+		},
+	}
+}
+
+// captureBuffer keeps the first limit bytes that are written to it and counts the rest
+type captureBuffer struct {
+	limit int
+
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	size int64
+}
+
+func (b *captureBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.size += int64(len(p))
+	if n := b.limit - b.buf.Len(); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		b.buf.Write(p[:n])
+	}
+	return len(p), nil
+}
+
+// Bytes returns the kept bytes, bodies larger than limit are cut
+func (b *captureBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+// Size returns the number of bytes that were written
+func (b *captureBuffer) Size() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size
+}
+
+// captureReader copies everything that is read into a captureBuffer
+type captureReader struct {
+	io.ReadCloser
+	buf *captureBuffer
+}
+
+func (r *captureReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.buf.Write(p[:n])
+	return n, err
+}
@@ -0,0 +1,128 @@
+package talon_access_proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestDebugCapture(t *testing.T) {
+	var gotDebugHeader string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotDebugHeader = r.Header.Get("X-TAP-Debug")
+		w.Write([]byte(`{"effects":[]}`))
+	}))
+	defer server.Close()
+
+	const secret = "0123456789abcdef"
+	logs := &logBuffer{}
+	// the logger is at info level, only the capture sees debug lines
+	logger := zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(logs), zap.InfoLevel))
+	tap, err := New(Config{
+		TalonAPI: server.URL,
+		Logger:   logger,
+		Application: map[string]*ApplicationConfig{
+			"1": &ApplicationConfig{
+				CalculateHMAC:  true,
+				ApplicationKey: "fefecafe",
+			},
+		},
+		Debug: &DebugConfig{
+			Secret:   secret,
+			Response: true,
+		},
+	})
+	require.NoError(t, err)
+	defer tap.Close()
+
+	send := func(debug string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/v1/customer_sessions/1", strings.NewReader(`{"payload":{}}`))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("X-TAP-Application", "1")
+		if len(debug) > 0 {
+			r.Header.Set("X-TAP-Debug", debug)
+		}
+		w := httptest.NewRecorder()
+		tap.Handler().ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+		return w
+	}
+
+	t.Run("Capture", func(t *testing.T) {
+		logs.Lines(t)
+		w := send(secret)
+		require.Empty(t, gotDebugHeader)
+
+		data, err := base64.StdEncoding.DecodeString(w.Header().Get("X-TAP-Debug-Capture"))
+		require.NoError(t, err)
+		var lines []map[string]interface{}
+		require.NoError(t, json.Unmarshal(data, &lines))
+		messages := make(map[string]map[string]interface{})
+		for _, line := range lines {
+			messages[line["msg"].(string)] = line
+		}
+		for _, msg := range []string{"Got Request", "Performing Request", "Calculating HMAC", "HMAC Calculated", "Connect done", "Got first response byte", "Request succeeded"} {
+			require.Contains(t, messages, msg)
+		}
+		// the secret is masked
+		require.Equal(t, []interface{}{redacted}, messages["Got Request"]["headers"].(map[string]interface{})["X-Tap-Debug"])
+
+		var capture map[string]interface{}
+		for _, line := range logs.Lines(t) {
+			require.NotEqual(t, "debug", line["level"])
+			if line["msg"] == "Debug capture" {
+				capture = line
+			}
+		}
+		require.NotNil(t, capture)
+		require.Equal(t, `{"payload":{}}`, capture["requestBody"])
+		require.Equal(t, `{"effects":[]}`, capture["responseBody"])
+		require.True(t, len(capture["lines"].([]interface{})) >= len(lines))
+	})
+
+	t.Run("Wrong secret", func(t *testing.T) {
+		logs.Lines(t)
+		w := send("wrong")
+		require.Empty(t, gotDebugHeader)
+		require.Empty(t, w.Header().Get("X-TAP-Debug-Capture"))
+		logs.mu.Lock()
+		require.NotContains(t, logs.buf.String(), "Debug capture")
+		logs.mu.Unlock()
+	})
+
+	t.Run("Without header", func(t *testing.T) {
+		w := send("")
+		require.Empty(t, w.Header().Get("X-TAP-Debug-Capture"))
+	})
+}
+
+func TestCaptureBuffer(t *testing.T) {
+	b := captureBuffer{limit: 4}
+	b.Write([]byte("abc"))
+	b.Write([]byte("def"))
+	require.Equal(t, "abcd", string(b.Bytes()))
+	require.Equal(t, int64(6), b.Size())
+}
+
+func TestDebugCaptureBody(t *testing.T) {
+	redaction := &RedactionConfig{BodyFields: []string{"email"}, MaxBodySize: 16}
+	redaction.setDefaults()
+	c := &debugCapture{redaction: redaction}
+	c.requestBody.limit = 64
+
+	// the field after MaxBodySize is masked before the body is cut
+	c.requestBody.Write([]byte(`{"padding":"0123456789","email":"jane@example.com"}`))
+	require.Equal(t, `{"email":"[REDAC...(truncated)`, c.body(&c.requestBody))
+
+	// bodies that were cut while capturing cannot be parsed
+	c.responseBody.limit = 8
+	c.responseBody.Write([]byte(`{"email":"jane@example.com"}`))
+	require.Equal(t, "[REDACTED: body is larger than Debug.MaxCaptureSize]", c.body(&c.responseBody))
+}
@@ -7,6 +7,7 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
@@ -23,6 +24,11 @@ type cacheEntry struct {
 
 // DNSCache is a net.Resolver compliant DNS Resolver
 type DNSCache struct {
+	// counters, accessed atomically
+	hits      uint64
+	misses    uint64
+	refreshes uint64
+
 	Logger            *zap.Logger
 	MaxLookupAttempts int
 	DialTimeout       time.Duration
@@ -30,6 +36,7 @@ type DNSCache struct {
 	server            dns.Server
 	mu                sync.Mutex
 	closed            bool
+	done              chan struct{}
 	localAddr         *net.UDPAddr
 }
 
@@ -63,11 +70,16 @@ func (cache *DNSCache) Server() error {
 	}
 
 	cache.closed = false
+	cache.done = make(chan struct{})
 
 	go func() {
+		defer close(cache.done)
 		defer cache.server.PacketConn.Close()
 		if err := cache.server.ActivateAndServe(); err != nil {
-			if !cache.closed {
+			cache.mu.Lock()
+			closed := cache.closed
+			cache.mu.Unlock()
+			if !closed {
 				cache.Logger.Debug("DNSCache got error", zap.String("error", err.Error()))
 				serverStarted <- err
 			}
@@ -119,6 +131,7 @@ func (cache *DNSCache) refreshCacheEntries(entry *cacheEntry) error {
 	net := entry.OriginServerNet
 	s := entry.RR.Header().String()
 	cache.Logger.Debug("DNSCache refreshing", zap.String("host", entry.RR.Header().Name))
+	atomic.AddUint64(&cache.refreshes, 1)
 	cache.mu.Lock()
 	entry.Refreshing = true
 	for i := len(cache.entries) - 1; i >= 0; i-- {
@@ -137,10 +150,18 @@ func (cache *DNSCache) addCacheEntries(name string, entries []dns.RR, dst *[]dns
 	}
 }
 
-// Close closes an DNSCache Server (started with Server())
+// Close closes an DNSCache Server (started with Server()) and waits until it exited,
+// it is safe to call Close multiple times
 func (cache *DNSCache) Close() {
+	cache.mu.Lock()
+	if cache.closed {
+		cache.mu.Unlock()
+		return
+	}
 	cache.closed = true
+	cache.mu.Unlock()
 	cache.server.PacketConn.Close()
+	<-cache.done
 }
 
 // Resolver returns an net.Resolver that can be used
@@ -246,7 +267,34 @@ func (cache *DNSCache) Addr() string {
 // Lookup looks up an entry in the cache
 func (cache *DNSCache) Lookup(host string, Qclass uint16, Qtype uint16) ([]dns.RR, error) {
 	sanitizeHost(&host)
-	return cache.getCacheEntries(host, Qclass, Qtype)
+	entries, err := cache.getCacheEntries(host, Qclass, Qtype)
+	if err == nil {
+		if len(entries) > 0 {
+			atomic.AddUint64(&cache.hits, 1)
+		} else {
+			atomic.AddUint64(&cache.misses, 1)
+		}
+	}
+	return entries, err
+}
+
+// Stats contains the counters of a DNSCache
+type Stats struct {
+	// Hits is the number of lookups that were answered from the cache
+	Hits uint64
+	// Misses is the number of lookups without a cache entry
+	Misses uint64
+	// Refreshes is the number of expired entries that were resolved again
+	Refreshes uint64
+}
+
+// Stats returns a snapshot of the counters
+func (cache *DNSCache) Stats() Stats {
+	return Stats{
+		Hits:      atomic.LoadUint64(&cache.hits),
+		Misses:    atomic.LoadUint64(&cache.misses),
+		Refreshes: atomic.LoadUint64(&cache.refreshes),
+	}
 }
 
 func sanitizeHost(host *string) {
@@ -31,6 +31,7 @@ func TestCache(t *testing.T) {
 	entries, err := cache.Resolver().LookupTXT(context.Background(), "example.com")
 	require.NoError(t, err)
 	require.EqualValues(t, []string{"Hello World"}, entries)
+	require.EqualValues(t, 1, cache.Stats().Hits)
 }
 
 func TestCacheMiss(t *testing.T) {
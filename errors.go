@@ -0,0 +1,174 @@
+package talon_access_proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+// errorResponse is sent to the client when a request could not be proxied
+type errorResponse struct {
+	status     int
+	retryAfter int
+	// Code is a stable identifier for the kind of error, it is also sent in the X-TAP-Error header
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// bodyReadError is returned when the body of the incoming request could not be read
+type bodyReadError struct {
+	err error
+}
+
+func (e *bodyReadError) Error() string {
+	return "Unable to read request body: " + e.err.Error()
+}
+
+// clientBody marks errors that occur while reading the body of the incoming request,
+// so they can be told apart from upstream errors
+type clientBody struct {
+	io.ReadCloser
+}
+
+func (b clientBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		err = &bodyReadError{err}
+	}
+	return n, err
+}
+
+// classifyError maps an error of doHTTPRequest to the response for the client
+func classifyError(err error) *errorResponse {
+	newResponse := func(status int, code, message string) *errorResponse {
+		return &errorResponse{status: status, Code: code, Message: message}
+	}
+
+	switch err {
+	case errMissingSignature:
+		return newResponse(http.StatusUnauthorized, "missing_signature", err.Error())
+	case errInvalidSignature:
+		return newResponse(http.StatusUnauthorized, "invalid_signature", err.Error())
+	case errLoopDetected:
+		return newResponse(http.StatusLoopDetected, "loop_detected", err.Error())
+	case errInvalidTimeout:
+		return newResponse(http.StatusBadRequest, "invalid_timeout", err.Error())
+	}
+
+	for e := err; e != nil; e = unwrapError(e) {
+		switch e := e.(type) {
+		case *circuitOpenError:
+			res := newResponse(http.StatusServiceUnavailable, "circuit_open", "Talon API is unavailable")
+			res.retryAfter = int(math.Max(1, math.Ceil(e.retryAfter.Seconds())))
+			return res
+		case *rateLimitError:
+			res := newResponse(http.StatusTooManyRequests, "rate_limited", "Rate limit exceeded")
+			res.retryAfter = int(math.Max(1, math.Ceil(e.retryAfter.Seconds())))
+			return res
+		case *overloadedError:
+			res := newResponse(http.StatusServiceUnavailable, "overloaded", "Proxy is overloaded")
+			res.retryAfter = int(math.Max(1, math.Ceil(e.retryAfter.Seconds())))
+			return res
+		case *throttledError:
+			res := newResponse(http.StatusTooManyRequests, "throttled", "Talon API is throttling requests")
+			res.retryAfter = int(math.Max(1, math.Ceil(e.retryAfter.Seconds())))
+			return res
+		case *bodyReadError:
+			return newResponse(http.StatusBadRequest, "invalid_body", e.Error())
+		}
+	}
+
+	if isError(err, context.Canceled) {
+		// nginx uses this status for requests the client canceled
+		return newResponse(499, "client_closed_request", "Client closed request")
+	}
+	isTimeout := func(e error) bool {
+		netErr, ok := e.(net.Error)
+		return ok && netErr.Timeout()
+	}
+	if isError(err, context.DeadlineExceeded) || findError(err, isTimeout) != nil {
+		return newResponse(http.StatusGatewayTimeout, "upstream_timeout", "Talon API did not respond in time")
+	}
+
+	isDNSError := func(e error) bool {
+		_, ok := e.(*net.DNSError)
+		return ok
+	}
+	if findError(err, isDNSError) != nil {
+		return newResponse(http.StatusBadGateway, "upstream_dns_error", "Unable to resolve Talon API")
+	}
+	if isTLSError(err) {
+		return newResponse(http.StatusBadGateway, "upstream_tls_error", "TLS handshake with Talon API failed")
+	}
+	if isConnectionError(err) {
+		return newResponse(http.StatusBadGateway, "upstream_connection_error", "Unable to connect to Talon API")
+	}
+	if _, ok := err.(*url.Error); ok {
+		return newResponse(http.StatusBadGateway, "upstream_error", "Talon API request failed")
+	}
+
+	return newResponse(http.StatusInternalServerError, "internal_error", "Internal error")
+}
+
+func isTLSError(err error) bool {
+	return findError(err, func(e error) bool {
+		switch e.(type) {
+		case tls.RecordHeaderError, x509.UnknownAuthorityError, x509.HostnameError, x509.CertificateInvalidError:
+			return true
+		}
+		return false
+	}) != nil
+}
+
+// unwrapError returns the error err wraps or nil, it knows the wrappers of the standard library and this package
+// (errors.Unwrap is not available before Go 1.13)
+func unwrapError(err error) error {
+	switch e := err.(type) {
+	case *url.Error:
+		return e.Err
+	case *net.OpError:
+		return e.Err
+	case *os.SyscallError:
+		return e.Err
+	case *bodyReadError:
+		return e.err
+	}
+	return nil
+}
+
+// findError returns the first error in the chain of err that match reports true for
+func findError(err error, match func(error) bool) error {
+	for ; err != nil; err = unwrapError(err) {
+		if match(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// isError reports whether target is in the chain of err
+func isError(err, target error) bool {
+	return findError(err, func(e error) bool { return e == target }) != nil
+}
+
+// writeError sends res as JSON to the client
+func writeError(w http.ResponseWriter, res *errorResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("X-TAP", Version)
+	w.Header().Set("X-TAP-Error", res.Code)
+	if res.retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(res.retryAfter))
+	}
+	w.WriteHeader(res.status)
+	json.NewEncoder(w).Encode(res)
+}
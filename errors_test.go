@@ -0,0 +1,112 @@
+package talon_access_proxy
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestClassifyError(t *testing.T) {
+	upstreamError := func(err error) error {
+		return &url.Error{Op: "Get", URL: "https://demo.talon.one", Err: err}
+	}
+	tests := []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{errInvalidSignature, http.StatusUnauthorized, "invalid_signature"},
+		{&circuitOpenError{retryAfter: time.Second}, http.StatusServiceUnavailable, "circuit_open"},
+		{&overloadedError{reason: "timeout", retryAfter: time.Second}, http.StatusServiceUnavailable, "overloaded"},
+		{&throttledError{retryAfter: time.Second}, http.StatusTooManyRequests, "throttled"},
+		{&rateLimitError{key: "ip", retryAfter: 200 * time.Millisecond}, http.StatusTooManyRequests, "rate_limited"},
+		{&bodyReadError{errors.New("unexpected EOF")}, http.StatusBadRequest, "invalid_body"},
+		{upstreamError(&bodyReadError{errors.New("unexpected EOF")}), http.StatusBadRequest, "invalid_body"},
+		{upstreamError(context.DeadlineExceeded), http.StatusGatewayTimeout, "upstream_timeout"},
+		{upstreamError(&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "demo.talon.one"}}), http.StatusBadGateway, "upstream_dns_error"},
+		{upstreamError(&net.OpError{Op: "dial", Err: errors.New("connection refused")}), http.StatusBadGateway, "upstream_connection_error"},
+		{upstreamError(x509.UnknownAuthorityError{}), http.StatusBadGateway, "upstream_tls_error"},
+		{upstreamError(errors.New("EOF")), http.StatusBadGateway, "upstream_error"},
+		{errors.New("unknown"), http.StatusInternalServerError, "internal_error"},
+	}
+	for _, test := range tests {
+		res := classifyError(test.err)
+		require.Equal(t, test.status, res.status, test.err.Error())
+		require.Equal(t, test.code, res.Code, test.err.Error())
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	unreachable := httptest.NewServer(nil)
+	unreachable.Close()
+
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	tap, err := New(Config{
+		TalonAPI: unreachable.URL,
+		Logger:   logger,
+		Application: map[string]*ApplicationConfig{
+			"1": &ApplicationConfig{
+				CalculateHMAC:  true,
+				ApplicationKey: "deadbeef",
+			},
+		},
+	})
+	require.NoError(t, err)
+	defer tap.Close()
+
+	decode := func(w *httptest.ResponseRecorder) errorResponse {
+		var res errorResponse
+		require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&res))
+		require.Equal(t, res.Code, w.Header().Get("X-TAP-Error"))
+		require.Len(t, res.RequestID, 32)
+		return res
+	}
+
+	t.Run("Upstream", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/v1/customer_sessions/1", nil)
+		w := httptest.NewRecorder()
+		tap.Handler().ServeHTTP(w, r)
+		require.Equal(t, http.StatusBadGateway, w.Code)
+		require.Equal(t, "upstream_connection_error", decode(w).Code)
+	})
+
+	t.Run("Body", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPut, "/v1/customer_sessions/1", failingReader{})
+		r.Header.Set("X-TAP-Application", "1")
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		tap.Handler().ServeHTTP(w, r)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		require.Equal(t, "invalid_body", decode(w).Code)
+	})
+
+	t.Run("Panic", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/v1/customer_sessions/1", nil)
+		r = r.WithContext(withRequestInfo(r.Context(), &requestInfo{ID: newRequestID()}))
+		w := httptest.NewRecorder()
+		func() {
+			defer tap.mux.recover(&responseWriter{ResponseWriter: w}, r)
+			panic("boom")
+		}()
+		require.Equal(t, http.StatusInternalServerError, w.Code)
+		require.Equal(t, "internal_error", decode(w).Code)
+	})
+}
@@ -0,0 +1,147 @@
+package talon_access_proxy
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+var errLoopDetected = errors.New("Request loop detected")
+
+// hopHeaders only apply to a single connection and are never forwarded (RFC 7230, section 6.1)
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// copyHeader adds all values of src to dst
+func copyHeader(dst, src http.Header) {
+	for k, v := range src {
+		dst[k] = append(dst[k], v...)
+	}
+}
+
+// removeHopHeaders removes the hop-by-hop headers and the headers listed in the Connection header
+func removeHopHeaders(header http.Header) {
+	for _, value := range header["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = textproto.TrimString(name); len(name) > 0 {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+}
+
+// isLoop reports whether r was already sent by this proxy
+func (t *Tap) isLoop(r *http.Request) bool {
+	if len(r.Header.Get("X-TAP")) > 0 {
+		return true
+	}
+	for _, value := range r.Header["Via"] {
+		for _, hop := range strings.Split(value, ",") {
+			// received-protocol received-by [comment]
+			fields := strings.Fields(hop)
+			if len(fields) >= 2 && strings.EqualFold(fields[1], t.Config.Forwarding.Name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// forwardHeaders returns the header for the outgoing request of r
+func (t *Tap) forwardHeaders(r *http.Request) (http.Header, error) {
+	if t.isLoop(r) {
+		return nil, errLoopDetected
+	}
+
+	header := make(http.Header, len(r.Header)+4)
+	copyHeader(header, r.Header)
+	removeHopHeaders(header)
+
+	config := &t.Config.Forwarding
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = r.RemoteAddr
+	}
+	if config.XForwardedFor && len(clientIP) > 0 {
+		forwardedFor := clientIP
+		if prior := header["X-Forwarded-For"]; len(prior) > 0 {
+			forwardedFor = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		header.Set("X-Forwarded-For", forwardedFor)
+	}
+	if config.Forwarded {
+		header.Add("Forwarded", forwardedElement(r, clientIP))
+	}
+	if config.Via {
+		header.Add("Via", via(r.ProtoMajor, r.ProtoMinor, config.Name))
+	}
+	header.Set("X-TAP", Version)
+	return header, nil
+}
+
+// responseHeaders copies the header of res to dst
+func (t *Tap) responseHeaders(dst http.Header, res *http.Response) {
+	removeHopHeaders(res.Header)
+	copyHeader(dst, res.Header)
+	if t.Config.Forwarding.Via {
+		dst.Add("Via", via(res.ProtoMajor, res.ProtoMinor, t.Config.Forwarding.Name))
+	}
+	dst.Set("X-TAP", Version)
+}
+
+func via(major, minor int, name string) string {
+	return strconv.Itoa(major) + "." + strconv.Itoa(minor) + " " + name
+}
+
+// forwardedElement creates a forwarded-element (RFC 7239, section 4) for r
+func forwardedElement(r *http.Request, clientIP string) string {
+	var pairs []string
+	if len(clientIP) > 0 {
+		if strings.Contains(clientIP, ":") {
+			// IPv6 addresses are enclosed in brackets
+			clientIP = "[" + clientIP + "]"
+		}
+		pairs = append(pairs, "for="+forwardedValue(clientIP))
+	}
+	if len(r.Host) > 0 {
+		pairs = append(pairs, "host="+forwardedValue(r.Host))
+	}
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	pairs = append(pairs, "proto="+proto)
+	return strings.Join(pairs, ";")
+}
+
+// forwardedValue returns value as a token, or as a quoted-string if it contains other characters
+func forwardedValue(value string) string {
+	for _, c := range value {
+		if !isTokenChar(c) {
+			return strconv.Quote(value)
+		}
+	}
+	return value
+}
+
+func isTokenChar(c rune) bool {
+	if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' {
+		return true
+	}
+	return strings.ContainsRune("!#$%&'*+-.^_`|~", c)
+}
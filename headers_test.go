@@ -0,0 +1,86 @@
+package talon_access_proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestRemoveHopHeaders(t *testing.T) {
+	header := http.Header{
+		"Connection":    {"close, X-Private"},
+		"Keep-Alive":    {"timeout=5"},
+		"Upgrade":       {"websocket"},
+		"X-Private":     {"secret"},
+		"Authorization": {"ApiKey-v1 key"},
+	}
+	removeHopHeaders(header)
+	require.Equal(t, http.Header{"Authorization": {"ApiKey-v1 key"}}, header)
+}
+
+func TestForwarding(t *testing.T) {
+	var received http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header
+		w.Header().Add("Set-Cookie", "a=1")
+		w.Header().Add("Set-Cookie", "b=2")
+		w.Header().Set("Connection", "X-Upstream-Private")
+		w.Header().Set("X-Upstream-Private", "secret")
+	}))
+	defer server.Close()
+
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	tap, err := New(Config{
+		TalonAPI: server.URL,
+		Logger:   logger,
+		Forwarding: ForwardingConfig{
+			XForwardedFor: true,
+			Forwarded:     true,
+			Via:           true,
+		},
+	})
+	require.NoError(t, err)
+	defer tap.Close()
+
+	t.Run("Request and Response", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/v1/customer_sessions/1", nil)
+		r.RemoteAddr = "[2001:db8::1]:1234"
+		r.Header.Set("X-Forwarded-For", "192.0.2.1")
+		r.Header.Set("Connection", "X-Hop")
+		r.Header.Set("X-Hop", "1")
+		r.Header.Add("Accept", "application/json")
+		r.Header.Add("Accept", "text/plain")
+		w := httptest.NewRecorder()
+		tap.Handler().ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		require.Empty(t, received.Get("X-Hop"))
+		require.Equal(t, []string{"application/json", "text/plain"}, received["Accept"])
+		require.Equal(t, "192.0.2.1, 2001:db8::1", received.Get("X-Forwarded-For"))
+		require.Equal(t, `for="[2001:db8::1]";host=example.com;proto=http`, received.Get("Forwarded"))
+		require.Equal(t, "1.1 talon-access-proxy", received.Get("Via"))
+		require.Equal(t, Version, received.Get("X-TAP"))
+
+		require.Equal(t, []string{"a=1", "b=2"}, w.Header()["Set-Cookie"])
+		require.Empty(t, w.Header().Get("X-Upstream-Private"))
+		require.Equal(t, "1.1 talon-access-proxy", w.Header().Get("Via"))
+	})
+
+	t.Run("Loop", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/v1/customer_sessions/1", nil)
+		r.Header.Set("Via", "1.1 other, 1.1 talon-access-proxy")
+		w := httptest.NewRecorder()
+		tap.Handler().ServeHTTP(w, r)
+		require.Equal(t, http.StatusLoopDetected, w.Code)
+
+		r = httptest.NewRequest(http.MethodGet, "/v1/customer_sessions/1", nil)
+		r.Header.Set("X-TAP", Version)
+		w = httptest.NewRecorder()
+		tap.Handler().ServeHTTP(w, r)
+		require.Equal(t, http.StatusLoopDetected, w.Code)
+	})
+}
@@ -0,0 +1,287 @@
+package talon_access_proxy
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// instruments records the events of requests, all metrics are derived from them.
+// All methods can be called on a nil *instruments, in that case nothing is recorded.
+type instruments struct {
+	registry registry
+	trace    *httptrace.ClientTrace
+
+	requests         *metric
+	requestDuration  *metric
+	upstreamRequests *metric
+	upstreamDuration *metric
+	upstreamInflight *metric
+	connections      *metric
+	dials            *metric
+	signatures       *metric
+	errors           *metric
+	cacheRequests    *metric
+	rateLimits       *metric
+	throttled        *metric
+}
+
+func newInstruments(t *Tap, statsd *statsdClient) *instruments {
+	in := &instruments{}
+	r := &in.registry
+	r.statsd = statsd
+	in.requests = r.counter("tap_requests_total", "Requests handled by the proxy.", "application", "method", "path", "status")
+	in.requestDuration = r.histogram("tap_request_duration_seconds", "Duration of requests handled by the proxy.", defaultBuckets, "application", "method", "path")
+	r.gaugeFunc("tap_requests_in_flight", "Requests that are currently handled by the proxy.", nil, func(emit func(float64, ...string)) {
+		t.mu.Lock()
+		inflight := t.inflight
+		t.mu.Unlock()
+		emit(float64(inflight))
+	})
+	in.upstreamRequests = r.counter("tap_upstream_requests_total", "Requests sent to the Talon API, status is error if no response was received.", "upstream", "status")
+	in.upstreamDuration = r.histogram("tap_upstream_request_duration_seconds", "Time until the response headers of the Talon API were received.", defaultBuckets, "upstream")
+	in.upstreamInflight = r.gauge("tap_upstream_requests_in_flight", "Requests to the Talon API that are waiting for a response.", "upstream")
+	in.connections = r.counter("tap_upstream_connections_total", "Connections used for requests to the Talon API.", "reused")
+	in.dials = r.counter("tap_upstream_dials_total", "New connections to the Talon API.", "result")
+	in.signatures = r.counter("tap_hmac_total", "HMAC signatures that were calculated or verified.", "application", "operation", "result")
+	in.errors = r.counter("tap_errors_total", "Requests that could not be proxied, by error code.", "code")
+	in.cacheRequests = r.counter("tap_cache_requests_total", "Requests that used the response cache.", "result")
+	in.rateLimits = r.counter("tap_rate_limit_requests_total", "Requests that were checked against a rate limit, result is allowed or limited.", "application", "key", "result")
+	r.gaugeFunc("tap_rate_limit_buckets", "Token buckets of the rate limits that are not full.", []string{"application", "key"}, func(emit func(float64, ...string)) {
+		for id, limiter := range t.rateLimiters {
+			for i := range limiter.limits {
+				emit(float64(limiter.buckets[i].Len()), id, limiter.limits[i].Key)
+			}
+		}
+	})
+	r.gaugeFunc("tap_concurrency_limit", "Adaptive limit of the requests in flight.", nil, func(emit func(float64, ...string)) {
+		if t.limiter != nil {
+			emit(float64(t.limiter.State().Limit))
+		}
+	})
+	r.gaugeFunc("tap_concurrency_in_flight", "Requests that hold a slot of the concurrency limit.", nil, func(emit func(float64, ...string)) {
+		if t.limiter != nil {
+			emit(float64(t.limiter.State().InFlight))
+		}
+	})
+	r.gaugeFunc("tap_concurrency_queued", "Requests that wait for a slot of the concurrency limit.", nil, func(emit func(float64, ...string)) {
+		if t.limiter != nil {
+			emit(float64(t.limiter.State().Queued))
+		}
+	})
+	r.counterFunc("tap_concurrency_shed_total", "Requests that were shed because the queue was full or no slot freed up in time.", []string{"reason"}, func(emit func(float64, ...string)) {
+		for reason, n := range t.limiter.State().Shed {
+			emit(float64(n), reason)
+		}
+	})
+	in.throttled = r.counter("tap_throttle_requests_total", "Requests to endpoints the Talon API is throttling, result is delayed or rejected.", "application", "method", "path", "result")
+	r.gaugeFunc("tap_throttle_rate", "Requests per second sent to endpoints the Talon API is throttling.", []string{"application", "method", "path"}, func(emit func(float64, ...string)) {
+		for key, state := range throttleStatesByLabel(t.throttler.States()) {
+			emit(state.Rate, key.application, key.method, key.path)
+		}
+	})
+	r.gaugeFunc("tap_throttle_cooldown_seconds", "Remaining time no requests are sent to endpoints the Talon API is throttling.", []string{"application", "method", "path"}, func(emit func(float64, ...string)) {
+		for key, state := range throttleStatesByLabel(t.throttler.States()) {
+			emit(state.CoolDown.Seconds(), key.application, key.method, key.path)
+		}
+	})
+	r.counterFunc("tap_coalesced_requests_total", "Requests that were answered with the response of an identical request.", nil, func(emit func(float64, ...string)) {
+		emit(float64(t.Stats().CoalescedRequests))
+	})
+	r.counterFunc("tap_coalesce_fallbacks_total", "Requests that waited for an identical request which was canceled, they were sent on their own.", nil, func(emit func(float64, ...string)) {
+		emit(float64(t.Stats().CoalesceFallbacks))
+	})
+	r.gaugeFunc("tap_circuit_breaker_state", "State of the circuit breakers, 1 for the current state.", []string{"breaker", "state"}, func(emit func(float64, ...string)) {
+		for name, state := range t.CircuitBreakers() {
+			for _, s := range []breakerState{breakerClosed, breakerOpen, breakerHalfOpen} {
+				var value float64
+				if s.String() == state {
+					value = 1
+				}
+				emit(value, name, s.String())
+			}
+		}
+	})
+	r.counterFunc("tap_dnscache_hits_total", "DNS lookups that were answered from the cache.", nil, func(emit func(float64, ...string)) {
+		emit(float64(t.dnscache.Stats().Hits))
+	})
+	r.counterFunc("tap_dnscache_misses_total", "DNS lookups without a cache entry.", nil, func(emit func(float64, ...string)) {
+		emit(float64(t.dnscache.Stats().Misses))
+	})
+	r.counterFunc("tap_dnscache_refreshes_total", "Expired DNS cache entries that were resolved again.", nil, func(emit func(float64, ...string)) {
+		emit(float64(t.dnscache.Stats().Refreshes))
+	})
+
+	in.trace = &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			in.connections.Add(1, strconv.FormatBool(info.Reused))
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err != nil {
+				in.dials.Add(1, "error")
+				return
+			}
+			in.dials.Add(1, "success")
+		},
+	}
+	return in
+}
+
+// requestDone records a request that was handled by the proxy
+func (in *instruments) requestDone(info *requestInfo, method, path string, status int, header http.Header) {
+	if in == nil {
+		return
+	}
+	path = normalizePath(path)
+	in.requests.Add(1, info.ApplicationID, method, path, strconv.Itoa(status))
+	in.requestDuration.Observe(time.Since(info.Start).Seconds(), info.ApplicationID, method, path)
+	if result := header.Get("X-TAP-Cache"); len(result) > 0 {
+		in.cacheRequests.Add(1, strings.ToLower(result))
+	}
+}
+
+// requestError records a request that could not be proxied
+func (in *instruments) requestError(code string) {
+	if in == nil {
+		return
+	}
+	in.errors.Add(1, code)
+}
+
+// upstreamStart records a request that is sent to an upstream
+func (in *instruments) upstreamStart(upstream string) {
+	if in == nil {
+		return
+	}
+	in.upstreamInflight.Add(1, upstream)
+}
+
+// upstreamDone records the outcome of a request that was sent to an upstream
+func (in *instruments) upstreamDone(upstream string, res *http.Response, err error, duration time.Duration) {
+	if in == nil {
+		return
+	}
+	in.upstreamInflight.Add(-1, upstream)
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(res.StatusCode)
+		in.upstreamDuration.Observe(duration.Seconds(), upstream)
+	}
+	in.upstreamRequests.Add(1, upstream, status)
+}
+
+// signature records a calculated or verified HMAC
+func (in *instruments) signature(application, operation, result string) {
+	if in == nil {
+		return
+	}
+	in.signatures.Add(1, application, operation, result)
+}
+
+// rateLimit records a request that was checked against a rate limit
+func (in *instruments) rateLimit(application, key, result string) {
+	if in == nil {
+		return
+	}
+	in.rateLimits.Add(1, application, key, result)
+}
+
+// throttle records a request that was delayed or rejected because its endpoint is throttled
+func (in *instruments) throttle(key throttleKey, result string) {
+	if in == nil {
+		return
+	}
+	in.throttled.Add(1, key.application, key.method, normalizePath(key.path), result)
+}
+
+// throttleStatesByLabel merges the states of the endpoints that share a path label,
+// the rates are summed up and the longest cool-down is kept
+func throttleStatesByLabel(states map[throttleKey]throttleState) map[throttleKey]throttleState {
+	merged := make(map[throttleKey]throttleState, len(states))
+	for key, state := range states {
+		key.path = normalizePath(key.path)
+		m := merged[key]
+		m.Rate += state.Rate
+		if state.CoolDown > m.CoolDown {
+			m.CoolDown = state.CoolDown
+		}
+		merged[key] = m
+	}
+	return merged
+}
+
+// clientTrace returns the httptrace hooks for requests to the upstreams
+func (in *instruments) clientTrace() *httptrace.ClientTrace {
+	if in == nil {
+		return nil
+	}
+	return in.trace
+}
+
+// knownRoutes are the Talon API routes that are used as path label, :id matches any segment.
+// Every other path is reported as "other", so clients cannot create an unbounded number of series.
+var knownRoutes = func() [][]string {
+	var routes [][]string
+	for _, version := range []string{"v1", "v2"} {
+		for _, route := range []string{
+			"applications",
+			"applications/:id",
+			"applications/:id/campaigns",
+			"applications/:id/campaigns/:id",
+			"applications/:id/campaigns/:id/coupons",
+			"applications/:id/campaigns/:id/coupons/:id",
+			"applications/:id/customers",
+			"applications/:id/sessions",
+			"attributes",
+			"attributes/:id",
+			"campaigns",
+			"campaigns/:id",
+			"coupons",
+			"coupon_reservations/:id",
+			"coupon_reservations/customerprofiles/:id",
+			"customer_profiles/:id",
+			"customer_profiles/:id/inventory",
+			"customer_sessions/:id",
+			"events",
+			"referrals",
+			"sessions",
+			"users",
+			"users/:id",
+		} {
+			routes = append(routes, append([]string{version}, strings.Split(route, "/")...))
+		}
+	}
+	return routes
+}()
+
+// normalizePath maps a Talon API path to its route, so it can be used as a label,
+// e.g. /v1/applications/1/campaigns/2 becomes /v1/applications/:id/campaigns/:id
+func normalizePath(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for _, route := range knownRoutes {
+		if matchKnownRoute(route, segments) {
+			return "/" + strings.Join(route, "/")
+		}
+	}
+	return "other"
+}
+
+func matchKnownRoute(route, segments []string) bool {
+	if len(route) != len(segments) {
+		return false
+	}
+	for i, segment := range route {
+		if segment == ":id" {
+			if len(segments[i]) <= 0 {
+				return false
+			}
+			continue
+		}
+		if segment != segments[i] {
+			return false
+		}
+	}
+	return true
+}
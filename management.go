@@ -0,0 +1,163 @@
+package talon_access_proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// management injects Management API credentials into requests,
+// either a static management key or a session token obtained via /v1/sessions
+type management struct {
+	tap    *Tap
+	config *ManagementConfig
+	logger *zap.Logger
+
+	mu         sync.Mutex
+	token      string
+	validUntil time.Time
+}
+
+func newManagement(t *Tap) *management {
+	return &management{
+		tap:    t,
+		config: t.Config.Management,
+		logger: t.Config.Logger.With(zap.String("tag", "Management")),
+	}
+}
+
+// Match reports whether r is a Management API request, if so the PathPrefix is stripped from the url
+func (m *management) Match(r *http.Request) bool {
+	if !hasPathPrefix(r.URL.Path, m.config.PathPrefix) {
+		return false
+	}
+	r.URL.Path = "/" + strings.TrimLeft(strings.TrimPrefix(r.URL.Path, m.config.PathPrefix), "/")
+	r.URL.RawPath = ""
+	return true
+}
+
+// Do sends req with management credentials using do.
+// If a session token was used and Talon answers with 401, the session is renewed and req is sent again.
+func (m *management) Do(logger *zap.Logger, req *http.Request, do roundTripFunc) (*http.Response, error) {
+	if len(m.config.Key) > 0 {
+		logger.Debug("Adding ManagementKey to request")
+		req.Header.Set("Authorization", "ManagementKey-v1 "+m.config.Key)
+		return do(req)
+	}
+
+	token, err := m.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	// buffer the body, so we can send it again if the session expired
+	if req.GetBody == nil && req.Body != nil && req.Body != http.NoBody {
+		body, err := readBody(req.Body, m.tap.Config.BodyMemoryLimit)
+		if err != nil {
+			return nil, err
+		}
+		body.SetRequestBody(req)
+	}
+
+	logger.Debug("Adding session token to request")
+	req.Header.Set("Authorization", "Bearer "+token)
+	res, err := do(req)
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+	res.Body.Close()
+
+	logger.Debug("Session was rejected, logging in again")
+	// requests that were rejected at the same time share the new session
+	m.Invalidate(token)
+	token, err = m.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	if !rewindBody(req) {
+		return nil, errors.New("Unable to send request again: body is not replayable")
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return do(req)
+}
+
+// Token returns the cached session token, or logs in if there is no valid one
+func (m *management) Token() (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.token) > 0 && time.Now().Before(m.validUntil) {
+		return m.token, nil
+	}
+	token, err := m.login()
+	if err != nil {
+		m.logger.Error("Login failed", zap.String("email", m.config.Email), zap.String("error", err.Error()))
+		return "", err
+	}
+	m.token = token
+	m.validUntil = time.Now().Add(m.config.sessionLifetime)
+	m.logger.Debug("Logged in", zap.String("email", m.config.Email), zap.Time("validUntil", m.validUntil))
+	return token, nil
+}
+
+// Invalidate drops token from the cache, if it is still the current one
+func (m *management) Invalidate(token string) {
+	m.mu.Lock()
+	if m.token == token {
+		m.token = ""
+	}
+	m.mu.Unlock()
+}
+
+func (m *management) login() (string, error) {
+	payload, err := json.Marshal(map[string]string{
+		"email":    m.config.Email,
+		"password": m.config.Password,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	u := m.tap.upstreams.Active().url
+	u.Path = "/v1/sessions"
+	u.RawQuery = ""
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-TAP", Version)
+	// m.mu is held during the login, do not let the requests that wait for it hang
+	ctx, cancel := context.WithTimeout(context.Background(), m.config.loginTimeout)
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	res, err := m.tap.roundTrip(m.logger, req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("Unable to login: Response code was %d", res.StatusCode)
+	}
+
+	var session struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&session); err != nil {
+		return "", fmt.Errorf("Unable to login: %s", err.Error())
+	}
+	if len(session.Token) <= 0 {
+		return "", errors.New("Unable to login: Response contained no token")
+	}
+	return session.Token, nil
+}
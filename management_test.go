@@ -0,0 +1,185 @@
+package talon_access_proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestManagement(t *testing.T) {
+	var logins int
+	var validToken, gotAuthorization, gotPath, gotBody string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/sessions" {
+			var credentials map[string]string
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&credentials))
+			if credentials["email"] != "admin@example.com" || credentials["password"] != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			logins++
+			validToken = fmt.Sprintf("token%d", logins)
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]string{"token": validToken})
+			return
+		}
+		gotAuthorization = r.Header.Get("Authorization")
+		gotPath = r.URL.Path
+		data, _ := ioutil.ReadAll(r.Body)
+		gotBody = string(data)
+		if strings.HasPrefix(gotAuthorization, "Bearer ") && gotAuthorization != "Bearer "+validToken {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	newTap := func(management *ManagementConfig) *Tap {
+		logger, err := zap.NewDevelopment()
+		require.NoError(t, err)
+		tap, err := New(Config{
+			TalonAPI:   server.URL,
+			Logger:     logger,
+			Management: management,
+		})
+		require.NoError(t, err)
+		return tap
+	}
+
+	send := func(tap *Tap, path, body string) int {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		tap.Handler().ServeHTTP(w, r)
+		return w.Code
+	}
+
+	t.Run("Key", func(t *testing.T) {
+		tap := newTap(&ManagementConfig{Key: "secret-key"})
+		defer tap.Close()
+		require.Equal(t, http.StatusOK, send(tap, "/management/v1/applications", ""))
+		require.Equal(t, "ManagementKey-v1 secret-key", gotAuthorization)
+		require.Equal(t, "/v1/applications", gotPath)
+	})
+
+	t.Run("Session", func(t *testing.T) {
+		logins = 0
+		tap := newTap(&ManagementConfig{
+			PathPrefix: "mgmt",
+			Email:      "admin@example.com",
+			Password:   "secret",
+		})
+		defer tap.Close()
+
+		require.Equal(t, http.StatusOK, send(tap, "/mgmt/v1/campaigns", "a"))
+		require.Equal(t, "Bearer token1", gotAuthorization)
+		require.Equal(t, "/v1/campaigns", gotPath)
+		require.Equal(t, 1, logins)
+
+		require.Equal(t, http.StatusOK, send(tap, "/mgmt/v1/campaigns", "b"))
+		require.Equal(t, 1, logins)
+
+		// expire the session on the server side
+		validToken = "expired"
+		require.Equal(t, http.StatusOK, send(tap, "/mgmt/v1/campaigns", "c"))
+		require.Equal(t, "Bearer token2", gotAuthorization)
+		require.Equal(t, "c", gotBody)
+		require.Equal(t, 2, logins)
+	})
+
+	t.Run("Session Lifetime", func(t *testing.T) {
+		logins = 0
+		tap := newTap(&ManagementConfig{
+			Email:           "admin@example.com",
+			Password:        "secret",
+			SessionLifetime: "1ns",
+		})
+		defer tap.Close()
+		require.Equal(t, http.StatusOK, send(tap, "/management/v1/campaigns", ""))
+		require.Equal(t, http.StatusOK, send(tap, "/management/v1/campaigns", ""))
+		require.Equal(t, 2, logins)
+	})
+
+	t.Run("Invalid Config", func(t *testing.T) {
+		config := Config{
+			TalonAPI:   server.URL,
+			Management: &ManagementConfig{Email: "admin@example.com"},
+		}
+		require.Error(t, config.SetDefaults())
+	})
+}
+
+func TestManagementRenewal(t *testing.T) {
+	var mu sync.Mutex
+	var logins int
+	var rejected sync.WaitGroup
+	rejected.Add(2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/sessions" {
+			mu.Lock()
+			logins++
+			token := fmt.Sprintf("token%d", logins)
+			mu.Unlock()
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]string{"token": token})
+			return
+		}
+		if r.Header.Get("Authorization") == "Bearer token1" {
+			// both requests are rejected before either of them logs in again
+			rejected.Done()
+			rejected.Wait()
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	tap, err := New(Config{
+		TalonAPI:   server.URL,
+		Logger:     logger,
+		Management: &ManagementConfig{Email: "admin@example.com", Password: "secret", LoginTimeout: "50ms"},
+	})
+	require.NoError(t, err)
+	defer tap.Close()
+
+	t.Run("Concurrent", func(t *testing.T) {
+		token, err := tap.management.Token()
+		require.NoError(t, err)
+		require.Equal(t, "token1", token)
+
+		codes := make(chan int)
+		for i := 0; i < 2; i++ {
+			go func() {
+				w := httptest.NewRecorder()
+				tap.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/management/v1/campaigns", nil))
+				codes <- w.Code
+			}()
+		}
+		require.Equal(t, http.StatusOK, <-codes)
+		require.Equal(t, http.StatusOK, <-codes)
+		mu.Lock()
+		defer mu.Unlock()
+		require.Equal(t, 2, logins)
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		tap.management.Invalidate("token2")
+		// the Talon API does not answer
+		tap.client.Transport = transportFunc(func(r *http.Request) (*http.Response, error) {
+			<-r.Context().Done()
+			return nil, r.Context().Err()
+		})
+		start := time.Now()
+		_, err := tap.management.Token()
+		require.Error(t, err)
+		require.True(t, time.Since(start) < time.Second)
+	})
+}
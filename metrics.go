@@ -0,0 +1,254 @@
+package talon_access_proxy
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type metricKind int
+
+const (
+	counterMetric metricKind = iota
+	gaugeMetric
+	histogramMetric
+)
+
+func (k metricKind) String() string {
+	switch k {
+	case counterMetric:
+		return "counter"
+	case gaugeMetric:
+		return "gauge"
+	case histogramMetric:
+		return "histogram"
+	}
+	return "untyped"
+}
+
+// defaultBuckets are the histogram buckets in seconds
+var defaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metric is a family of time series with the same name and label names
+type metric struct {
+	name    string
+	help    string
+	kind    metricKind
+	labels  []string
+	buckets []float64
+	// collect reads the values when the metric is exposed, it is used instead of series
+	collect func(emit func(value float64, labelValues ...string))
+	// statsd receives all updates if it is set
+	statsd *statsdClient
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	// histograms only, counts are per bucket and not cumulative
+	counts []uint64
+	count  uint64
+}
+
+// get returns the series for the label values, m.mu must be held
+func (m *metric) get(labelValues []string) *series {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if m.kind == histogramMetric {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// Add adds v to a counter or gauge
+func (m *metric) Add(v float64, labelValues ...string) {
+	m.mu.Lock()
+	s := m.get(labelValues)
+	s.value += v
+	value := s.value
+	m.mu.Unlock()
+	if m.statsd != nil {
+		if m.kind == counterMetric {
+			m.statsd.Count(m, v, labelValues)
+		} else {
+			m.statsd.Gauge(m, value, labelValues)
+		}
+	}
+}
+
+// Set sets a gauge to v
+func (m *metric) Set(v float64, labelValues ...string) {
+	m.mu.Lock()
+	m.get(labelValues).value = v
+	m.mu.Unlock()
+	if m.statsd != nil {
+		m.statsd.Gauge(m, v, labelValues)
+	}
+}
+
+// Observe adds v to a histogram
+func (m *metric) Observe(v float64, labelValues ...string) {
+	m.mu.Lock()
+	s := m.get(labelValues)
+	for i, bound := range m.buckets {
+		if v <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.value += v
+	m.mu.Unlock()
+	if m.statsd != nil {
+		m.statsd.Timing(m, v, labelValues)
+	}
+}
+
+// snapshot returns a copy of all series sorted by their label values
+func (m *metric) snapshot() []series {
+	var list []series
+	if m.collect != nil {
+		m.collect(func(value float64, labelValues ...string) {
+			list = append(list, series{labelValues: labelValues, value: value})
+		})
+	} else {
+		m.mu.Lock()
+		for _, s := range m.series {
+			c := *s
+			c.counts = append([]uint64(nil), s.counts...)
+			list = append(list, c)
+		}
+		m.mu.Unlock()
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return strings.Join(list[i].labelValues, "\xff") < strings.Join(list[j].labelValues, "\xff")
+	})
+	return list
+}
+
+// registry holds metrics in the order they were registered
+type registry struct {
+	metrics []*metric
+	// statsd receives the updates of all metrics registered after it was set
+	statsd *statsdClient
+}
+
+func (r *registry) register(m *metric) *metric {
+	m.series = make(map[string]*series)
+	m.statsd = r.statsd
+	r.metrics = append(r.metrics, m)
+	return m
+}
+
+func (r *registry) counter(name, help string, labels ...string) *metric {
+	return r.register(&metric{name: name, help: help, kind: counterMetric, labels: labels})
+}
+
+func (r *registry) gauge(name, help string, labels ...string) *metric {
+	return r.register(&metric{name: name, help: help, kind: gaugeMetric, labels: labels})
+}
+
+func (r *registry) histogram(name, help string, buckets []float64, labels ...string) *metric {
+	return r.register(&metric{name: name, help: help, kind: histogramMetric, labels: labels, buckets: buckets})
+}
+
+func (r *registry) counterFunc(name, help string, labels []string, collect func(emit func(value float64, labelValues ...string))) *metric {
+	return r.register(&metric{name: name, help: help, kind: counterMetric, labels: labels, collect: collect})
+}
+
+func (r *registry) gaugeFunc(name, help string, labels []string, collect func(emit func(value float64, labelValues ...string))) *metric {
+	return r.register(&metric{name: name, help: help, kind: gaugeMetric, labels: labels, collect: collect})
+}
+
+// write writes all metrics in the Prometheus text exposition format
+func (r *registry) write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, m := range r.metrics {
+		list := m.snapshot()
+		if len(list) <= 0 {
+			continue
+		}
+		bw.WriteString("# HELP " + m.name + " " + escapeHelp(m.help) + "\n")
+		bw.WriteString("# TYPE " + m.name + " " + m.kind.String() + "\n")
+		for _, s := range list {
+			if m.kind != histogramMetric {
+				writeSample(bw, m.name, m.labels, s.labelValues, "", "", s.value)
+				continue
+			}
+			var cumulative uint64
+			for i, bound := range m.buckets {
+				cumulative += s.counts[i]
+				writeSample(bw, m.name+"_bucket", m.labels, s.labelValues, "le", formatFloat(bound), float64(cumulative))
+			}
+			writeSample(bw, m.name+"_bucket", m.labels, s.labelValues, "le", "+Inf", float64(s.count))
+			writeSample(bw, m.name+"_sum", m.labels, s.labelValues, "", "", s.value)
+			writeSample(bw, m.name+"_count", m.labels, s.labelValues, "", "", float64(s.count))
+		}
+	}
+	return bw.Flush()
+}
+
+func writeSample(w *bufio.Writer, name string, labels, labelValues []string, extraLabel, extraValue string, value float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || len(extraLabel) > 0 {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(label + `="` + escapeLabelValue(labelValues[i]) + `"`)
+		}
+		if len(extraLabel) > 0 {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extraLabel + `="` + extraValue + `"`)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(s string) string {
+	return labelValueReplacer.Replace(s)
+}
+
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+// ServeHTTP serves the metrics to Prometheus
+func (r *registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.write(w)
+}
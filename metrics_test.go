@@ -0,0 +1,140 @@
+package talon_access_proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestNormalizePath(t *testing.T) {
+	require.Equal(t, "/v1/applications/:id/campaigns/:id", normalizePath("/v1/applications/1/campaigns/2"))
+	require.Equal(t, "/v2/customer_sessions/:id", normalizePath("/v2/customer_sessions/session-1"))
+	require.Equal(t, "/v1/attributes", normalizePath("/v1/attributes/"))
+	require.Equal(t, "other", normalizePath("/v1/Not-A-Collection"))
+	require.Equal(t, "other", normalizePath("/v1/random_collection/1"))
+	require.Equal(t, "other", normalizePath("/v3/campaigns"))
+	require.Equal(t, "other", normalizePath("/v1/customer_sessions//"))
+	require.Equal(t, "other", normalizePath("/favicon.ico"))
+}
+
+func TestRegistry(t *testing.T) {
+	var r registry
+	counter := r.counter("test_total", "A counter.", "code")
+	histogram := r.histogram("test_seconds", "A histogram.", []float64{0.1, 1})
+	r.gauge("test_empty", "Not exposed without values.")
+	r.gaugeFunc("test_func", "A gauge func.", nil, func(emit func(float64, ...string)) {
+		emit(3)
+	})
+
+	counter.Add(1, "b")
+	counter.Add(2, `a"\`)
+	histogram.Observe(0.05)
+	histogram.Observe(0.5)
+	histogram.Observe(5)
+
+	var buffer bytes.Buffer
+	require.NoError(t, r.write(&buffer))
+	require.Equal(t, `# HELP test_total A counter.
+# TYPE test_total counter
+test_total{code="a\"\\"} 2
+test_total{code="b"} 1
+# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 1
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 5.55
+test_seconds_count 3
+# HELP test_func A gauge func.
+# TYPE test_func gauge
+test_func 3
+`, buffer.String())
+}
+
+func TestMetrics(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+
+	scrape := func(handler http.Handler) string {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		return w.Body.String()
+	}
+
+	t.Run("Handler", func(t *testing.T) {
+		tap, err := New(Config{
+			TalonAPI: server.URL,
+			Logger:   logger,
+			Metrics:  &MetricsConfig{},
+			Application: map[string]*ApplicationConfig{
+				"1": &ApplicationConfig{
+					CalculateHMAC:  true,
+					ApplicationKey: "deadbeef",
+				},
+			},
+		})
+		require.NoError(t, err)
+		defer tap.Close()
+
+		r := httptest.NewRequest(http.MethodPut, "/v2/customer_sessions/abc", bytes.NewBufferString("{}"))
+		r.Header.Set("X-TAP-Application", "1")
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		tap.Handler().ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		metrics := scrape(tap.Handler())
+		require.Contains(t, metrics, `tap_requests_total{application="1",method="PUT",path="/v2/customer_sessions/:id",status="200"} 1`)
+		require.Contains(t, metrics, `tap_request_duration_seconds_count{application="1",method="PUT",path="/v2/customer_sessions/:id"} 1`)
+		require.Contains(t, metrics, `tap_upstream_requests_total{upstream="`+server.Listener.Addr().String()+`",status="200"} 1`)
+		require.Contains(t, metrics, `tap_upstream_connections_total{reused="false"} 1`)
+		require.Contains(t, metrics, `tap_upstream_dials_total{result="success"} 1`)
+		require.Contains(t, metrics, `tap_hmac_total{application="1",operation="sign",result="signed"} 1`)
+		// the scrape itself is in flight
+		require.Contains(t, metrics, `tap_requests_in_flight 1`)
+		require.Contains(t, metrics, `tap_dnscache_hits_total 0`)
+	})
+
+	t.Run("Address", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		address := listener.Addr().String()
+		listener.Close()
+
+		tap, err := New(Config{
+			TalonAPI: server.URL,
+			Logger:   logger,
+			Metrics: &MetricsConfig{
+				Address: address,
+			},
+		})
+		require.NoError(t, err)
+
+		// the proxy does not serve the metrics
+		w := httptest.NewRecorder()
+		tap.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Empty(t, w.Header().Get("Content-Type"))
+
+		res, err := http.Get("http://" + address + "/metrics")
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		require.NoError(t, err)
+		require.Contains(t, string(body), `tap_requests_total{application="",method="GET",path="other",status="200"} 1`)
+
+		tap.Close()
+		_, err = http.Get("http://" + address + "/metrics")
+		require.Error(t, err)
+	})
+}
@@ -3,6 +3,8 @@ package talon_access_proxy
 import (
 	"io"
 	"net/http"
+	"runtime/debug"
+	"time"
 
 	"go.uber.org/zap"
 )
@@ -19,37 +21,175 @@ func newMux(t *Tap) *mux {
 	}
 }
 
-func (mux *mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	mux.Logger.Debug("Got Request", zap.String("method", r.Method), zap.String("url", r.URL.String()), zap.Int64("content-length", r.ContentLength), zap.Any("headers", r.Header))
+func (mux *mux) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	info := &requestInfo{ID: r.Header.Get(mux.Tap.Config.RequestIDHeader), Start: time.Now()}
+	if !validRequestID(info.ID) {
+		info.ID = newRequestID()
+	}
+	info.Timings = &phaseTimings{}
+	r = r.WithContext(withRequestInfo(r.Context(), info))
+	rw.Header().Set(mux.Tap.Config.RequestIDHeader, info.ID)
+	info.Debug = mux.Tap.startDebugCapture(r)
+	logger := info.Debug.wrap(mux.Logger.With(zap.String("requestId", info.ID)))
+	w := &responseWriter{ResponseWriter: rw}
+	var metered bool
+	defer func() {
+		if metered {
+			mux.Tap.instruments.requestDone(info, r.Method, r.URL.Path, w.status, w.Header())
+			info.Span.SetAttribute("http.status_code", w.status)
+			if len(info.ApplicationID) > 0 {
+				info.Span.SetAttribute("talon.application_id", info.ApplicationID)
+			}
+			if len(info.TalonRequestID) > 0 {
+				info.Span.SetAttribute("talon.request_id", info.TalonRequestID)
+			}
+			if w.status >= http.StatusInternalServerError {
+				info.Span.SetError(http.StatusText(w.status))
+			}
+			info.Span.End()
+			mux.Tap.accessLog.Log(newAccessLogEntry(r, info, w))
+			if duration := time.Since(info.Start); mux.Tap.Config.Timing.slowThreshold > 0 && duration > mux.Tap.Config.Timing.slowThreshold {
+				logger.Warn("Slow request", zap.String("method", r.Method), zap.String("path", r.URL.Path), zap.Int("status", w.status), zap.Duration("duration", duration), zap.Object("timings", info.Timings))
+			} else {
+				logger.Debug("Request done", zap.Int("status", w.status), zap.Duration("duration", duration), zap.Object("timings", info.Timings))
+			}
+		}
+		info.Debug.emit(mux.Logger, info)
+	}()
+	defer mux.recover(w, r)
 
+	// health checks are answered during the shutdown, they are not in-flight requests
 	if r.URL.String() == "/.health" {
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-	
-	response, err := mux.Tap.doHTTPRequest(r)
+	if r.URL.String() == "/.ready" {
+		if !mux.Tap.Ready() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if !mux.Tap.acquire() {
+		writeError(w, &errorResponse{
+			status:    http.StatusServiceUnavailable,
+			Code:      "closed",
+			Message:   "Proxy is shut down",
+			RequestID: info.ID,
+		})
+		return
+	}
+	defer mux.Tap.release()
+
+	debug := logger.Core().Enabled(zap.DebugLevel)
+	if debug {
+		logger.Debug("Got Request", zap.String("method", r.Method), zap.String("url", r.URL.String()), zap.Int64("content-length", r.ContentLength), zap.Any("headers", mux.Tap.Config.Redaction.header(r.Header)))
+	}
+
+	if mux.Tap.Config.Metrics != nil && len(mux.Tap.Config.Metrics.Address) <= 0 && r.URL.Path == mux.Tap.Config.Metrics.Path {
+		mux.Tap.MetricsHandler().ServeHTTP(w, r)
+		return
+	}
+	metered = true
+	info.Span = mux.Tap.tracer.startRequest(r)
+	info.Span.SetAttribute("tap.request_id", info.ID)
+	r.Body = info.Debug.wrapBody(r.Body)
+
+	response, err := mux.Tap.limitedHTTPRequest(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		res := classifyError(err)
+		res.RequestID = info.ID
+		mux.Tap.instruments.requestError(res.Code)
+		info.Span.SetAttribute("tap.error", res.Code)
+		if res.status >= http.StatusInternalServerError {
+			logger.Warn("Request failed", zap.String("code", res.Code), zap.Error(err))
+		} else {
+			logger.Debug("Request failed", zap.String("code", res.Code), zap.Error(err))
+		}
+		info.Timings.setHeaders(time.Since(info.Start))
+		info.Timings.setServerTiming(w.Header(), &mux.Tap.Config.Timing)
+		info.Debug.setHeader(w.Header(), mux.Tap.Config.Debug)
+		writeError(w, res)
 		return
 	}
 
-	// copy all headers
-	for header, value := range response.Header {
-		w.Header().Set(header, value[0])
+	// copy all headers, the request id of the client takes precedence
+	mux.Tap.responseHeaders(w.Header(), response)
+	w.Header().Set(mux.Tap.Config.RequestIDHeader, info.ID)
+	if len(info.TalonRequestID) > 0 {
+		logger = logger.With(zap.String("talonRequestId", info.TalonRequestID))
 	}
-	w.Header().Set("X-TAP", Version)
 
-	mux.Logger.Debug("Sending Response",
-		zap.Int64("content-length", response.ContentLength),
-		zap.Any("headers", w.Header()))
+	if debug {
+		logger.Debug("Sending Response",
+			zap.Int64("content-length", response.ContentLength),
+			zap.Any("headers", mux.Tap.Config.Redaction.header(w.Header())))
+	}
 
+	info.Timings.setHeaders(time.Since(info.Start))
+	info.Timings.setServerTiming(w.Header(), &mux.Tap.Config.Timing)
+	info.Debug.setHeader(w.Header(), mux.Tap.Config.Debug)
 	w.WriteHeader(response.StatusCode)
 	if response.Body != nil {
 		defer response.Body.Close()
-		_, err := io.Copy(w, response.Body)
+		start := time.Now()
+		_, err := io.Copy(info.Debug.wrapWriter(w), response.Body)
+		info.Timings.setTransfer(time.Since(start))
 		if err != nil && err != io.EOF {
-			mux.Logger.Error("Unable to copy body", zap.Error(err))
+			logger.Error("Unable to copy body", zap.Error(err))
 		}
 	}
 }
+
+// recover turns a panic of the handler into an internal error response
+func (mux *mux) recover(w *responseWriter, r *http.Request) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	if v == http.ErrAbortHandler {
+		panic(v)
+	}
+	info := getRequestInfo(r.Context())
+	mux.Logger.Error("Recovered from panic",
+		zap.String("requestId", info.ID),
+		zap.Any("panic", v),
+		zap.ByteString("stack", debug.Stack()),
+	)
+	if w.status != 0 {
+		// the response already started, abort it so the client notices
+		panic(http.ErrAbortHandler)
+	}
+	writeError(w, &errorResponse{
+		status:    http.StatusInternalServerError,
+		Code:      "internal_error",
+		Message:   "Internal error",
+		RequestID: info.ID,
+	})
+}
+
+// responseWriter records the status and the size of the response
+type responseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
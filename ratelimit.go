@@ -0,0 +1,219 @@
+package talon_access_proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// rateLimitError is returned when a request exceeds a rate limit of its application
+type rateLimitError struct {
+	key        string
+	retryAfter time.Duration
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("Rate limit `%s' exceeded, retry after %s", e.key, e.retryAfter)
+}
+
+// sweepInterval is the interval buckets that are full again are removed in
+const sweepInterval = time.Minute
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// tokenBuckets is a set of token buckets with the same rate and burst, one per key
+type tokenBuckets struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newTokenBuckets(rate float64, burst int) *tokenBuckets {
+	return &tokenBuckets{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Take takes a token from the bucket of key, if there is none it returns false and the time until the next token
+func (b *tokenBuckets) Take(key string, now time.Time) (bool, time.Duration) {
+	return b.take(key, now, true)
+}
+
+// Check returns whether the bucket of key has a token without taking it, if there is none it also returns the time until the next token
+func (b *tokenBuckets) Check(key string, now time.Time) (bool, time.Duration) {
+	return b.take(key, now, false)
+}
+
+func (b *tokenBuckets) take(key string, now time.Time, take bool) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if now.Sub(b.lastSweep) >= sweepInterval {
+		b.sweep(now)
+	}
+	bucket, ok := b.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: b.burst, last: now}
+		b.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(b.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*b.rate)
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		if take {
+			bucket.tokens--
+		}
+		return true, 0
+	}
+	return false, time.Duration((1 - bucket.tokens) / b.rate * float64(time.Second))
+}
+
+// sweep removes the buckets that are full again, they behave like new ones, b.mu must be held
+func (b *tokenBuckets) sweep(now time.Time) {
+	for key, bucket := range b.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*b.rate >= b.burst {
+			delete(b.buckets, key)
+		}
+	}
+	b.lastSweep = now
+}
+
+// Len returns the number of tracked buckets
+func (b *tokenBuckets) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.buckets)
+}
+
+// rateLimiter holds the token buckets of the rate limits of an application
+type rateLimiter struct {
+	limits []RateLimit
+	// buckets are the buckets of limits, by index
+	buckets []*tokenBuckets
+	// mu makes checking and taking the tokens of a request atomic
+	mu sync.Mutex
+}
+
+func newRateLimiter(limits []RateLimit) *rateLimiter {
+	l := &rateLimiter{limits: limits}
+	for i := range limits {
+		l.buckets = append(l.buckets, newTokenBuckets(limits[i].Rate, limits[i].Burst))
+	}
+	return l
+}
+
+// rateLimit applies the rate limits of an application to req, it runs after signing so the body can be inspected.
+// Tokens are only taken if all limits pass, a rejected request does not count against the other limits.
+func (t *Tap) rateLimit(logger *zap.Logger, id string, incomingRequest, req *http.Request) error {
+	limiter, ok := t.rateLimiters[id]
+	if !ok {
+		return nil
+	}
+	keys := make([]string, len(limiter.limits))
+	for i := range limiter.limits {
+		limit := &limiter.limits[i]
+		if len(limit.Path) > 0 && !matchRoute(limit.Path, req.URL.Path) {
+			continue
+		}
+		// keys stay empty if the request has no value for them, e.g. the body field is missing
+		var err error
+		if keys[i], err = t.rateLimitKey(limit, incomingRequest, req); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	for i, key := range keys {
+		if len(key) <= 0 {
+			continue
+		}
+		if ok, retryAfter := limiter.buckets[i].Check(key, now); !ok {
+			logger.Debug("Rate limit exceeded", zap.String("key", limiter.limits[i].Key), zap.Duration("retryAfter", retryAfter))
+			t.instruments.rateLimit(id, limiter.limits[i].Key, "limited")
+			return &rateLimitError{key: limiter.limits[i].Key, retryAfter: retryAfter}
+		}
+	}
+	for i, key := range keys {
+		if len(key) <= 0 {
+			continue
+		}
+		limiter.buckets[i].Take(key, now)
+		t.instruments.rateLimit(id, limiter.limits[i].Key, "allowed")
+	}
+	return nil
+}
+
+// rateLimitKey returns the bucket of req, it is empty if req has no value for the key
+func (t *Tap) rateLimitKey(limit *RateLimit, incomingRequest, req *http.Request) (string, error) {
+	switch {
+	case limit.Key == "application":
+		return "application", nil
+	case limit.Key == "ip":
+		ip, _, err := net.SplitHostPort(incomingRequest.RemoteAddr)
+		if err != nil {
+			return incomingRequest.RemoteAddr, nil
+		}
+		return ip, nil
+	}
+
+	// body:<path>, buffer the body so it can still be sent
+	if req.Body == nil || req.Body == http.NoBody {
+		return "", nil
+	}
+	if req.GetBody == nil {
+		body, err := readBody(req.Body, t.Config.BodyMemoryLimit)
+		if err != nil {
+			return "", err
+		}
+		body.SetRequestBody(req)
+	}
+	reader, ok := req.Body.(*bodyReader)
+	if !ok {
+		return "", nil
+	}
+	// bodies that were spooled to disk are not inspected
+	return jsonField(reader.buffer.Bytes(), limit.path), nil
+}
+
+// jsonField returns the value of the field at path in a JSON document, it is empty if there is no such string or number
+func jsonField(data []byte, path []string) string {
+	if len(data) <= 0 {
+		return ""
+	}
+	var v interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil {
+		return ""
+	}
+	for _, key := range path {
+		object, ok := v.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		v = object[key]
+	}
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+	return ""
+}
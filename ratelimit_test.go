@@ -0,0 +1,133 @@
+package talon_access_proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestTokenBuckets(t *testing.T) {
+	b := newTokenBuckets(2, 2)
+	now := time.Now()
+
+	ok, _ := b.Take("a", now)
+	require.True(t, ok)
+	ok, _ = b.Take("a", now)
+	require.True(t, ok)
+	ok, retryAfter := b.Take("a", now)
+	require.False(t, ok)
+	require.Equal(t, 500*time.Millisecond, retryAfter)
+
+	// other keys have their own bucket
+	ok, _ = b.Take("b", now)
+	require.True(t, ok)
+
+	// a token is refilled every 500ms
+	ok, _ = b.Take("a", now.Add(500*time.Millisecond))
+	require.True(t, ok)
+	ok, retryAfter = b.Take("a", now.Add(600*time.Millisecond))
+	require.False(t, ok)
+	require.Equal(t, 400*time.Millisecond, retryAfter)
+	require.Equal(t, 2, b.Len())
+
+	// buckets that are full again are swept
+	ok, _ = b.Take("c", now.Add(sweepInterval))
+	require.True(t, ok)
+	require.Equal(t, 1, b.Len())
+}
+
+func TestJSONField(t *testing.T) {
+	data := []byte(`{"profileId":"p1","payload":{"customerId":12345678901234567890,"tags":["a"]}}`)
+	require.Equal(t, "p1", jsonField(data, []string{"profileId"}))
+	require.Equal(t, "12345678901234567890", jsonField(data, []string{"payload", "customerId"}))
+	require.Equal(t, "", jsonField(data, []string{"payload", "tags"}))
+	require.Equal(t, "", jsonField(data, []string{"missing", "field"}))
+	require.Equal(t, "", jsonField([]byte(`not json`), []string{"profileId"}))
+}
+
+func TestRateLimit(t *testing.T) {
+	var gotBodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		gotBodies = append(gotBodies, string(body))
+	}))
+	defer server.Close()
+
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	tap, err := New(Config{
+		TalonAPI: server.URL,
+		Logger:   logger,
+		Metrics:  &MetricsConfig{},
+		Application: map[string]*ApplicationConfig{
+			"1": &ApplicationConfig{
+				RateLimits: []RateLimit{
+					{Key: "ip", Rate: 0.5, Burst: 2},
+					{Key: "body:profileId", Rate: 0.1, Path: "/v2/customer_sessions/*"},
+				},
+			},
+		},
+	})
+	require.NoError(t, err)
+	defer tap.Close()
+
+	send := func(remoteAddr, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPut, path, strings.NewReader(body))
+		r.RemoteAddr = remoteAddr
+		r.Header.Set("X-TAP-Application", "1")
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		tap.Handler().ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("Body", func(t *testing.T) {
+		require.Equal(t, http.StatusOK, send("10.0.0.1:1234", "/v2/customer_sessions/a", `{"profileId":"p1"}`).Code)
+		require.Equal(t, []string{`{"profileId":"p1"}`}, gotBodies)
+
+		w := send("10.0.0.1:1234", "/v2/customer_sessions/b", `{"profileId":"p1"}`)
+		require.Equal(t, http.StatusTooManyRequests, w.Code)
+		require.Equal(t, "rate_limited", w.Header().Get("X-TAP-Error"))
+		require.Equal(t, "10", w.Header().Get("Retry-After"))
+		require.Len(t, gotBodies, 1)
+
+		// requests without the field or of other routes are not limited by it
+		require.Equal(t, http.StatusOK, send("10.0.0.2:1234", "/v2/customer_sessions/c", `{}`).Code)
+		require.Equal(t, http.StatusOK, send("10.0.0.2:1234", "/v2/customer_profiles/p1", `{"profileId":"p1"}`).Code)
+	})
+
+	t.Run("IP", func(t *testing.T) {
+		require.Equal(t, http.StatusOK, send("10.0.0.3:1234", "/v1/campaigns", "").Code)
+		require.Equal(t, http.StatusOK, send("10.0.0.3:5678", "/v1/campaigns", "").Code)
+		w := send("10.0.0.3:1234", "/v1/campaigns", "")
+		require.Equal(t, http.StatusTooManyRequests, w.Code)
+		require.Equal(t, "2", w.Header().Get("Retry-After"))
+		require.Equal(t, http.StatusOK, send("10.0.0.4:1234", "/v1/campaigns", "").Code)
+	})
+
+	t.Run("Rejected requests take no tokens", func(t *testing.T) {
+		// the ip limit passes but the body limit does not
+		require.Equal(t, http.StatusTooManyRequests, send("10.0.0.5:1234", "/v2/customer_sessions/d", `{"profileId":"p1"}`).Code)
+		require.Equal(t, http.StatusTooManyRequests, send("10.0.0.5:1234", "/v2/customer_sessions/d", `{"profileId":"p1"}`).Code)
+		require.Equal(t, http.StatusOK, send("10.0.0.5:1234", "/v1/campaigns", "").Code)
+		require.Equal(t, http.StatusOK, send("10.0.0.5:1234", "/v1/campaigns", "").Code)
+	})
+
+	t.Run("Metrics", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		tap.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		metrics := w.Body.String()
+		require.Contains(t, metrics, `tap_rate_limit_requests_total{application="1",key="body:profileId",result="allowed"} 1`)
+		require.Contains(t, metrics, `tap_rate_limit_requests_total{application="1",key="body:profileId",result="limited"} 3`)
+		require.Contains(t, metrics, `tap_rate_limit_requests_total{application="1",key="ip",result="limited"} 1`)
+		require.Contains(t, metrics, `tap_rate_limit_buckets{application="1",key="ip"} 5`)
+		require.Contains(t, metrics, `tap_rate_limit_buckets{application="1",key="body:profileId"} 1`)
+		require.Contains(t, metrics, `tap_errors_total{code="rate_limited"} 4`)
+	})
+}
@@ -0,0 +1,100 @@
+package talon_access_proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+)
+
+const redacted = "[REDACTED]"
+
+// credentialHeaders are always masked
+var credentialHeaders = []string{
+	"Api-Key",
+	"Authorization",
+	"Proxy-Authorization",
+	"Content-Signature",
+	"Cookie",
+	"Set-Cookie",
+	debugHeader,
+}
+
+// header returns a copy of h with the values of the sensitive headers masked
+func (config *RedactionConfig) header(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		if config.headers[http.CanonicalHeaderKey(k)] {
+			masked := make([]string, len(v))
+			for i := range masked {
+				masked[i] = redacted
+			}
+			c[k] = masked
+			continue
+		}
+		c[k] = v
+	}
+	return c
+}
+
+// body returns body for the log, the values of BodyFields are masked and the result is cut at MaxBodySize.
+// If BodyFields are set bodies that are not JSON are not logged at all.
+func (config *RedactionConfig) body(body []byte) string {
+	if len(body) <= 0 || config.MaxBodySize < 0 {
+		return ""
+	}
+	if len(config.fields) > 0 {
+		var v interface{}
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		if err := decoder.Decode(&v); err != nil {
+			return "[REDACTED: body is not JSON]"
+		}
+		redactJSON(v, config.fields)
+		var err error
+		if body, err = json.Marshal(v); err != nil {
+			return "[REDACTED: body is not JSON]"
+		}
+	}
+	if len(body) > config.MaxBodySize {
+		return string(body[:config.MaxBodySize]) + "...(truncated)"
+	}
+	return string(body)
+}
+
+// redactJSON masks the fields of v that match one of paths, a path can start at any object in v
+func redactJSON(v interface{}, paths [][]string) {
+	switch v := v.(type) {
+	case []interface{}:
+		for _, e := range v {
+			redactJSON(e, paths)
+		}
+	case map[string]interface{}:
+		for _, path := range paths {
+			redactPath(v, path)
+		}
+		for _, value := range v {
+			redactJSON(value, paths)
+		}
+	}
+}
+
+// redactPath masks the field of path starting at v, arrays are traversed and * matches any key
+func redactPath(v interface{}, path []string) {
+	switch v := v.(type) {
+	case []interface{}:
+		for _, e := range v {
+			redactPath(e, path)
+		}
+	case map[string]interface{}:
+		for key, value := range v {
+			if path[0] != "*" && path[0] != key {
+				continue
+			}
+			if len(path) == 1 {
+				v[key] = redacted
+			} else {
+				redactPath(value, path[1:])
+			}
+		}
+	}
+}
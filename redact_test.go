@@ -0,0 +1,103 @@
+package talon_access_proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestRedaction(t *testing.T) {
+	config := RedactionConfig{
+		Headers:    []string{"x-secret"},
+		BodyFields: []string{"profileId", "attributes.email", "cartItems.*"},
+	}
+	config.setDefaults()
+
+	t.Run("Header", func(t *testing.T) {
+		h := http.Header{
+			"Api-Key":      {"application=1.token=secret"},
+			"X-Secret":     {"a", "b"},
+			"Content-Type": {"application/json"},
+		}
+		require.Equal(t, http.Header{
+			"Api-Key":      {redacted},
+			"X-Secret":     {redacted, redacted},
+			"Content-Type": {"application/json"},
+		}, config.header(h))
+		// the original is not modified
+		require.Equal(t, "application=1.token=secret", h.Get("Api-Key"))
+	})
+
+	t.Run("Body", func(t *testing.T) {
+		require.Equal(t,
+			`{"payload":{"attributes":{"email":"[REDACTED]","name":"x"},"cartItems":[{"sku":"[REDACTED]"}],"profileId":"[REDACTED]","total":1.50}}`,
+			config.body([]byte(`{"payload":{"profileId":"p1","total":1.50,"attributes":{"email":"a@b.c","name":"x"},"cartItems":[{"sku":"s"}]}}`)),
+		)
+		require.Equal(t, `[{"profileId":"[REDACTED]"}]`, config.body([]byte(`[{"profileId":1}]`)))
+		require.Equal(t, "[REDACTED: body is not JSON]", config.body([]byte("profileId=p1")))
+		require.Equal(t, "", config.body(nil))
+	})
+
+	t.Run("MaxBodySize", func(t *testing.T) {
+		config := RedactionConfig{MaxBodySize: 4}
+		config.setDefaults()
+		require.Equal(t, "prof...(truncated)", config.body([]byte("profileId=p1")))
+		config.MaxBodySize = -1
+		require.Equal(t, "", config.body([]byte("profileId=p1")))
+	})
+}
+
+func TestRedactedLogs(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Set-Cookie", "session=secret")
+	}))
+	defer server.Close()
+
+	logs := &logBuffer{}
+	logger := zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(logs), zap.DebugLevel))
+	tap, err := New(Config{
+		TalonAPI: server.URL,
+		Logger:   logger,
+		Application: map[string]*ApplicationConfig{
+			"1": &ApplicationConfig{
+				CalculateHMAC:    true,
+				ApplicationKey:   "fefecafe",
+				ApplicationToken: "secret-token",
+			},
+		},
+		Redaction: RedactionConfig{
+			BodyFields: []string{"profileId"},
+		},
+	})
+	require.NoError(t, err)
+	defer tap.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/customer_sessions/1", strings.NewReader(`{"payload":{"profileId":"secret-profile"}}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer secret-bearer")
+	r.Header.Set("X-TAP-Application", "1")
+	w := httptest.NewRecorder()
+	tap.Handler().ServeHTTP(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	logs.mu.Lock()
+	output := logs.buf.String()
+	logs.mu.Unlock()
+	for _, secret := range []string{"secret-profile", "secret-bearer", "secret-token", "session=secret"} {
+		require.NotContains(t, output, secret)
+	}
+
+	var copied bool
+	for _, line := range logs.Lines(t) {
+		if line["msg"] == "Copied body" {
+			copied = true
+			require.Equal(t, `{"payload":{"profileId":"[REDACTED]"}}`, line["body"])
+		}
+	}
+	require.True(t, copied)
+}
@@ -0,0 +1,68 @@
+package talon_access_proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+type requestInfoKey struct{}
+
+// requestInfo carries per request state through the request context
+type requestInfo struct {
+	// ID identifies the request in logs and error responses
+	ID string
+	// TalonRequestID is the request id of the Talon API response
+	TalonRequestID string
+	// Start is the time the request was received
+	Start time.Time
+	// Timeout is the budget the client sent in the X-TAP-Timeout header
+	Timeout time.Duration
+	// FirstByteTimeout is the time an upstream may take to send the response headers
+	FirstByteTimeout time.Duration
+	// ApplicationID the request was resolved to
+	ApplicationID string
+	// Upstream and UpstreamStatus of the last request that was sent to the Talon API
+	Upstream       string
+	UpstreamStatus int
+	// Span of the request, nil if tracing is disabled
+	Span *span
+	// Debug captures the request, nil unless it carries the debug secret
+	Debug *debugCapture
+	// Timings is the latency breakdown of the request
+	Timings *phaseTimings
+}
+
+func withRequestInfo(ctx context.Context, info *requestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// getRequestInfo returns the requestInfo of ctx, it never returns nil
+func getRequestInfo(ctx context.Context) *requestInfo {
+	if info, ok := ctx.Value(requestInfoKey{}).(*requestInfo); ok {
+		return info
+	}
+	return &requestInfo{}
+}
+
+// validRequestID reports whether an inbound request id can be used, it must be printable ASCII
+// without spaces so it can not break log lines or headers
+func validRequestID(id string) bool {
+	if len(id) <= 0 || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random 128 bit id
+func newRequestID() string {
+	var id [16]byte
+	rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
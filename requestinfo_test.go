@@ -0,0 +1,123 @@
+package talon_access_proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// logBuffer collects the log lines of a logger
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) Lines(t *testing.T) []map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		if len(line) <= 0 {
+			continue
+		}
+		var fields map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(line), &fields))
+		lines = append(lines, fields)
+	}
+	b.buf.Reset()
+	return lines
+}
+
+func TestValidRequestID(t *testing.T) {
+	require.True(t, validRequestID("abc-123"))
+	require.False(t, validRequestID(""))
+	require.False(t, validRequestID("a b"))
+	require.False(t, validRequestID("a\nb"))
+	require.False(t, validRequestID(strings.Repeat("a", 129)))
+}
+
+func TestRequestID(t *testing.T) {
+	var gotRequestID string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotRequestID = r.Header.Get("X-Request-ID")
+		w.Header().Set("X-Request-Id", "talon-1")
+	}))
+	defer server.Close()
+
+	logs := &logBuffer{}
+	logger := zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(logs), zap.DebugLevel))
+	tap, err := New(Config{
+		TalonAPI: server.URL,
+		Logger:   logger,
+	})
+	require.NoError(t, err)
+	defer tap.Close()
+
+	send := func(id string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/v1/campaigns", nil)
+		if len(id) > 0 {
+			r.Header.Set("X-Request-ID", id)
+		}
+		w := httptest.NewRecorder()
+		tap.Handler().ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("Inbound", func(t *testing.T) {
+		logs.Lines(t)
+		w := send("client-1")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "client-1", gotRequestID)
+		require.Equal(t, []string{"client-1"}, w.Header()["X-Request-Id"])
+
+		var withTalonID int
+		for _, line := range logs.Lines(t) {
+			require.Equal(t, "client-1", line["requestId"], line["msg"])
+			if line["talonRequestId"] == "talon-1" {
+				withTalonID++
+			}
+		}
+		require.True(t, withTalonID >= 2)
+	})
+
+	t.Run("Generated", func(t *testing.T) {
+		w := send("")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Len(t, gotRequestID, 32)
+		first := w.Header().Get("X-Request-ID")
+		require.Equal(t, gotRequestID, first)
+		require.NotEqual(t, first, send("").Header().Get("X-Request-ID"))
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		w := send("a b")
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Len(t, gotRequestID, 32)
+		require.Equal(t, gotRequestID, w.Header().Get("X-Request-ID"))
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/v1/campaigns", nil)
+		r.Header.Set("X-Request-ID", "client-2")
+		r.Header.Set("X-TAP-Timeout", "soon")
+		w := httptest.NewRecorder()
+		tap.Handler().ServeHTTP(w, r)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+		require.Equal(t, "client-2", w.Header().Get("X-Request-ID"))
+		require.Contains(t, w.Body.String(), `"requestId":"client-2"`)
+	})
+}
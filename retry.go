@@ -0,0 +1,154 @@
+package talon_access_proxy
+
+import (
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// retryBudget limits the amount of retries relative to the amount of requests,
+// every request deposits ratio tokens, every retry withdraws one token
+type retryBudget struct {
+	mu     sync.Mutex
+	ratio  float64
+	max    float64
+	tokens float64
+}
+
+func newRetryBudget(ratio float64, burst int) *retryBudget {
+	return &retryBudget{
+		ratio:  ratio,
+		max:    float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+func (b *retryBudget) Deposit() {
+	b.mu.Lock()
+	b.tokens += b.ratio
+	if b.tokens > b.max {
+		b.tokens = b.max
+	}
+	b.mu.Unlock()
+}
+
+func (b *retryBudget) Withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// policy returns the first retry policy that matches req, nil if there is none
+func (config *RetryConfig) policy(req *http.Request) *RetryPolicy {
+	for i := range config.Policies {
+		policy := &config.Policies[i]
+		if len(policy.Methods) > 0 && !containsFold(policy.Methods, req.Method) {
+			continue
+		}
+		if !matchRoute(policy.Path, req.URL.Path) {
+			continue
+		}
+		return policy
+	}
+	return nil
+}
+
+// backoff returns the duration to wait before the attempt (starting with 1 for the first retry)
+func (policy *RetryPolicy) backoff(attempt int) time.Duration {
+	backoff := policy.initialBackoff
+	for i := 1; i < attempt && backoff < policy.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > policy.maxBackoff {
+		backoff = policy.maxBackoff
+	}
+	// use the half of the backoff as jitter
+	half := int64(backoff / 2)
+	if half <= 0 {
+		return backoff
+	}
+	return time.Duration(half + rand.Int63n(half))
+}
+
+func (policy *RetryPolicy) retryStatus(statusCode int) bool {
+	for _, code := range policy.RetryStatus {
+		if code == statusCode {
+			return true
+		}
+	}
+	return false
+}
+
+// retryRoundTrip sends req using roundTrip, and retries it if a retry policy allows it
+func (t *Tap) retryRoundTrip(logger *zap.Logger, req *http.Request) (*http.Response, error) {
+	t.retryBudget.Deposit()
+
+	policy := t.Config.Retry.policy(req)
+	if policy == nil || policy.MaxAttempts <= 1 {
+		return t.roundTrip(logger, req)
+	}
+
+	// buffer the body, so it can be replayed
+	if req.GetBody == nil && req.Body != nil && req.Body != http.NoBody {
+		body, err := readBody(req.Body, t.Config.BodyMemoryLimit)
+		if err != nil {
+			return nil, err
+		}
+		body.SetRequestBody(req)
+	}
+
+	for attempt := 1; ; attempt++ {
+		res, err := t.roundTrip(logger, req)
+		if attempt >= policy.MaxAttempts {
+			return res, err
+		}
+		if err != nil {
+			if _, ok := err.(*circuitOpenError); ok || req.Context().Err() != nil {
+				return res, err
+			}
+		} else if !policy.retryStatus(res.StatusCode) {
+			return res, err
+		}
+
+		if !t.retryBudget.Withdraw() {
+			logger.Debug("Retry budget exhausted")
+			return res, err
+		}
+		if !rewindBody(req) {
+			return res, err
+		}
+
+		backoff := policy.backoff(attempt)
+		if err != nil {
+			logger.Debug("Retrying request", zap.Int("attempt", attempt+1), zap.Duration("backoff", backoff), zap.String("error", err.Error()))
+		} else {
+			logger.Debug("Retrying request", zap.Int("attempt", attempt+1), zap.Duration("backoff", backoff), zap.Int("statusCode", res.StatusCode))
+			res.Body.Close()
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
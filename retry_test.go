@@ -0,0 +1,118 @@
+package talon_access_proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestMatchRoute(t *testing.T) {
+	require.True(t, matchRoute("", "/v1/campaigns"))
+	require.True(t, matchRoute("/v1/campaigns", "/v1/campaigns"))
+	require.True(t, matchRoute("/v1/customer_profiles/*", "/v1/customer_profiles/1"))
+	require.False(t, matchRoute("/v1/customer_profiles/*", "/v1/customer_profiles/1/loyalty"))
+	require.True(t, matchRoute("/v1/applications/**", "/v1/applications"))
+	require.True(t, matchRoute("/v1/applications/**", "/v1/applications/1/campaigns/2"))
+	require.True(t, matchRoute("/v1/*/**", "/v1/applications/1"))
+	require.False(t, matchRoute("/v1/applications/**", "/v2/applications/1"))
+	require.False(t, matchRoute("/v1/applications/**", "/v1"))
+	require.False(t, validRoute("/v1/["))
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := RetryPolicy{initialBackoff: 100 * time.Millisecond, maxBackoff: 300 * time.Millisecond}
+	for i := 0; i < 100; i++ {
+		backoff := policy.backoff(1)
+		require.True(t, backoff >= 50*time.Millisecond && backoff < 100*time.Millisecond, backoff.String())
+		backoff = policy.backoff(5)
+		require.True(t, backoff >= 150*time.Millisecond && backoff < 300*time.Millisecond, backoff.String())
+	}
+}
+
+func TestRetry(t *testing.T) {
+	// the counters are shared with the server goroutines
+	var mu sync.Mutex
+	var requests int
+	var failures int
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		requests++
+		bodies = append(bodies, string(data))
+		fail := failures > 0
+		if fail {
+			failures--
+		}
+		mu.Unlock()
+		if fail {
+			// drop the connection
+			conn, _, err := w.(http.Hijacker).Hijack()
+			require.NoError(t, err)
+			conn.Close()
+			return
+		}
+	}))
+	defer server.Close()
+
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	tap, err := New(Config{
+		TalonAPI: server.URL,
+		Logger:   logger,
+		Retry: RetryConfig{
+			Policies: []RetryPolicy{
+				{Methods: []string{"GET"}, InitialBackoff: "1ms"},
+				{Methods: []string{"POST"}, Path: "/v2/events", InitialBackoff: "1ms"},
+			},
+			Budget:      0.1,
+			BudgetBurst: 2,
+		},
+	})
+	require.NoError(t, err)
+	defer tap.Close()
+
+	// send sends a request to the proxy, the first fail requests to the server drop the connection
+	send := func(method, path, body string, fail int) (int, int, []string) {
+		mu.Lock()
+		requests, failures, bodies = 0, fail, nil
+		mu.Unlock()
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if len(body) <= 0 {
+			r = httptest.NewRequest(method, path, nil)
+		}
+		w := httptest.NewRecorder()
+		tap.Handler().ServeHTTP(w, r)
+		mu.Lock()
+		defer mu.Unlock()
+		return w.Code, requests, bodies
+	}
+
+	t.Run("GET", func(t *testing.T) {
+		code, requests, _ := send(http.MethodGet, "/v1/campaigns", "", 1)
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, 2, requests)
+	})
+	t.Run("Idempotent POST", func(t *testing.T) {
+		code, _, bodies := send(http.MethodPost, "/v2/events", "hello", 1)
+		require.Equal(t, http.StatusOK, code)
+		require.Equal(t, []string{"hello", "hello"}, bodies)
+	})
+	t.Run("POST", func(t *testing.T) {
+		code, requests, _ := send(http.MethodPost, "/v2/customer_sessions/1", "hello", 1)
+		require.Equal(t, http.StatusBadGateway, code)
+		require.Equal(t, 1, requests)
+	})
+	t.Run("Budget", func(t *testing.T) {
+		code, requests, _ := send(http.MethodGet, "/v1/campaigns", "", 10)
+		require.Equal(t, http.StatusBadGateway, code)
+		require.True(t, requests < 3)
+	})
+}
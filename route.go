@@ -0,0 +1,33 @@
+package talon_access_proxy
+
+import (
+	"path"
+	"strings"
+)
+
+// matchRoute reports whether the request path p matches pattern.
+// The pattern uses the path.Match syntax, so `*` matches a single path segment,
+// a trailing `/**` matches all sub paths. An empty pattern matches every path.
+func matchRoute(pattern, p string) bool {
+	if len(pattern) <= 0 {
+		return true
+	}
+	if strings.HasSuffix(pattern, "/**") {
+		// only match the leading segments of p against the prefix
+		pattern = strings.TrimSuffix(pattern, "/**")
+		n := strings.Count(pattern, "/") + 1
+		segments := strings.SplitN(p, "/", n+1)
+		if len(segments) < n {
+			return false
+		}
+		p = strings.Join(segments[:n], "/")
+	}
+	ok, err := path.Match(pattern, p)
+	return ok && err == nil
+}
+
+// validRoute reports whether pattern is a valid route pattern
+func validRoute(pattern string) bool {
+	_, err := path.Match(strings.TrimSuffix(pattern, "/**"), "")
+	return err == nil
+}
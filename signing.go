@@ -0,0 +1,187 @@
+package talon_access_proxy
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// signatureAlgorithms contains all supported hash functions for the HMAC calculation
+var signatureAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha256": sha256.New,
+}
+
+var (
+	errMissingSignature = errors.New("Content-Signature is missing")
+	errInvalidSignature = errors.New("Content-Signature is invalid")
+)
+
+// copyBufferPool holds buffers used to copy request bodies
+var copyBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 32*1024)
+		return &b
+	},
+}
+
+// signer calculates HMACs for an application, the hash instances are pooled
+type signer struct {
+	algorithm string
+	pool      sync.Pool
+}
+
+func newSigner(algorithm string, key []byte) *signer {
+	h := signatureAlgorithms[algorithm]
+	return &signer{
+		algorithm: algorithm,
+		pool: sync.Pool{
+			New: func() interface{} {
+				return hmac.New(h, key)
+			},
+		},
+	}
+}
+
+// Get returns a reset HMAC instance, return it with Put when done
+func (s *signer) Get() hash.Hash {
+	return s.pool.Get().(hash.Hash)
+}
+
+// Put returns an HMAC instance to the pool
+func (s *signer) Put(mac hash.Hash) {
+	mac.Reset()
+	s.pool.Put(mac)
+}
+
+// readBody copies body into a bodyBuffer while feeding it to all writers.
+// The caller is responsible to close the returned bodyBuffer.
+func readBody(body io.Reader, memoryLimit int64, writers ...io.Writer) (*bodyBuffer, error) {
+	buffer := newBodyBuffer(memoryLimit)
+	copyBuffer := copyBufferPool.Get().(*[]byte)
+	_, err := io.CopyBuffer(io.MultiWriter(append([]io.Writer{buffer}, writers...)...), body, *copyBuffer)
+	copyBufferPool.Put(copyBuffer)
+	if err != nil {
+		buffer.Close()
+		return nil, err
+	}
+	return buffer, nil
+}
+
+// parseContentSignature returns the signer and signature fields of a Content-Signature header
+func parseContentSignature(header string) (signer, signature string) {
+	fields := parseHeaderFields(header, ";")
+	return fields["signer"], fields["signature"]
+}
+
+// verifySignature reports whether the hex encoded signature matches the sum of mac
+func verifySignature(mac hash.Hash, signature string) bool {
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// signRequest verifies the inbound Content-Signature and signs the outgoing request, depending on the application config
+func (t *Tap) signRequest(logger *zap.Logger, id string, config *ApplicationConfig, incomingRequest, outgoingRequest *http.Request) error {
+	// requests without a body (e.g. GET) are not signed, chunked bodies have a ContentLength of -1.
+	// They are still verified, the client signs the empty body.
+	hasBody := incomingRequest.Body != nil && incomingRequest.Body != http.NoBody && incomingRequest.ContentLength != 0
+	sign := config.CalculateHMAC && hasBody && matchMediaType(incomingRequest.Header.Get("Content-Type"), config.SignContentTypes)
+	if !(sign || config.VerifyInboundSignature) {
+		return nil
+	}
+
+	var writers []io.Writer
+	var inboundMac, mac hash.Hash
+	var inboundSignature string
+	if config.VerifyInboundSignature {
+		var signer string
+		signer, inboundSignature = parseContentSignature(incomingRequest.Header.Get("Content-Signature"))
+		if len(inboundSignature) <= 0 || !strings.EqualFold(signer, id) {
+			logger.Debug("Rejecting request", zap.String("signer", signer), zap.Error(errMissingSignature))
+			t.instruments.signature(id, "verify", "missing")
+			return errMissingSignature
+		}
+		inboundMac = config.inboundSigner.Get()
+		defer config.inboundSigner.Put(inboundMac)
+		writers = append(writers, inboundMac)
+	}
+	if sign {
+		mac = config.signer.Get()
+		defer config.signer.Put(mac)
+		writers = append(writers, mac)
+	}
+
+	logger.Debug("Calculating HMAC", zap.String("algorithm", config.SignatureAlgorithm), zap.Bool("verify", config.VerifyInboundSignature), zap.Bool("sign", sign))
+	var body *bodyBuffer
+	if hasBody {
+		var err error
+		if body, err = readBody(incomingRequest.Body, t.Config.BodyMemoryLimit, writers...); err != nil {
+			return err
+		}
+		if logger.Core().Enabled(zapcore.DebugLevel) {
+			logger.Debug("Copied body", zap.Int64("size", body.Len()), zap.String("body", t.Config.Redaction.body(body.Bytes())))
+		}
+	}
+
+	if config.VerifyInboundSignature {
+		if !verifySignature(inboundMac, inboundSignature) {
+			logger.Debug("Rejecting request", zap.String("signer", id), zap.Error(errInvalidSignature))
+			t.instruments.signature(id, "verify", "invalid")
+			if body != nil {
+				body.Close()
+			}
+			return errInvalidSignature
+		}
+		logger.Debug("Inbound HMAC verified", zap.String("signer", id))
+		t.instruments.signature(id, "verify", "valid")
+		// the inbound signature was created with the client facing key, never forward it
+		outgoingRequest.Header.Del("Content-Signature")
+	}
+
+	if sign {
+		signature := hex.EncodeToString(mac.Sum(nil))
+		outgoingRequest.Header.Set("Content-Signature", fmt.Sprintf("signer=%s;signature=%s", id, signature))
+		logger.Debug("HMAC Calculated", zap.String("signer", id), zap.String("signature", signature))
+		t.instruments.signature(id, "sign", "signed")
+	}
+	if body != nil {
+		body.SetRequestBody(outgoingRequest)
+	}
+	return nil
+}
+
+// matchMediaType reports whether the media type of contentType is in mediaTypes,
+// parameters like charset are ignored, mediaTypes can contain wildcards (e.g. application/*)
+func matchMediaType(contentType string, mediaTypes []string) bool {
+	if len(contentType) <= 0 {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, m := range mediaTypes {
+		if m == mediaType || m == "*/*" {
+			return true
+		}
+		if strings.HasSuffix(m, "/*") && strings.HasPrefix(mediaType, m[:len(m)-1]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,222 @@
+package talon_access_proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestMatchMediaType(t *testing.T) {
+	mediaTypes := []string{"application/json", "text/*"}
+	require.True(t, matchMediaType("application/json", mediaTypes))
+	require.True(t, matchMediaType("Application/JSON; charset=utf-8", mediaTypes))
+	require.True(t, matchMediaType("text/plain", mediaTypes))
+	require.False(t, matchMediaType("application/xml", mediaTypes))
+	require.False(t, matchMediaType("", mediaTypes))
+	require.False(t, matchMediaType("application/json; =", mediaTypes))
+}
+
+func TestBodyBufferSpool(t *testing.T) {
+	buffer := newBodyBuffer(4)
+	_, err := buffer.Write([]byte("Hello"))
+	require.NoError(t, err)
+	_, err = buffer.Write([]byte(" World"))
+	require.NoError(t, err)
+	require.NotNil(t, buffer.file)
+	require.Nil(t, buffer.Bytes())
+	require.EqualValues(t, 11, buffer.Len())
+
+	name := buffer.file.Name()
+	for i := 0; i < 2; i++ {
+		r := buffer.NewReader()
+		data, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		require.Equal(t, "Hello World", string(data))
+		require.NoError(t, r.Close())
+	}
+	require.NoError(t, buffer.Close())
+	_, err = ioutil.ReadFile(name)
+	require.Error(t, err)
+}
+
+func TestSigning(t *testing.T) {
+	const key = "deadbeef"
+	keyBytes, err := hex.DecodeString(key)
+	require.NoError(t, err)
+
+	sign := func(h func() hash.Hash, body string) string {
+		mac := hmac.New(h, keyBytes)
+		mac.Write([]byte(body))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+
+	var gotSignature, gotBody string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotSignature = r.Header.Get("Content-Signature")
+		data, _ := ioutil.ReadAll(r.Body)
+		gotBody = string(data)
+	}))
+	defer server.Close()
+
+	newTap := func(algorithm string, memoryLimit int64) *Tap {
+		logger, err := zap.NewDevelopment()
+		require.NoError(t, err)
+		tap, err := New(Config{
+			TalonAPI:        server.URL,
+			Logger:          logger,
+			BodyMemoryLimit: memoryLimit,
+			Application: map[string]*ApplicationConfig{
+				"1": &ApplicationConfig{
+					CalculateHMAC:      true,
+					ApplicationKey:     key,
+					SignatureAlgorithm: algorithm,
+				},
+			},
+		})
+		require.NoError(t, err)
+		return tap
+	}
+
+	send := func(tap *Tap, contentType, body string) {
+		gotSignature, gotBody = "", ""
+		r := httptest.NewRequest(http.MethodPost, "/v1/sessions", strings.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		r.Header.Set("Content-Signature", "signer=1;signature=x")
+		w := httptest.NewRecorder()
+		tap.Handler().ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, body, gotBody)
+	}
+
+	t.Run("MD5 with charset", func(t *testing.T) {
+		tap := newTap("", 0)
+		defer tap.Close()
+		send(tap, "application/json; charset=utf-8", `{"a":1}`)
+		require.Equal(t, "signer=1;signature="+sign(md5.New, `{"a":1}`), gotSignature)
+	})
+	t.Run("SHA256", func(t *testing.T) {
+		tap := newTap("SHA256", 0)
+		defer tap.Close()
+		send(tap, "application/json", `{"a":1}`)
+		require.Equal(t, "signer=1;signature="+sign(sha256.New, `{"a":1}`), gotSignature)
+	})
+	t.Run("Spooled", func(t *testing.T) {
+		tap := newTap("sha256", 16)
+		defer tap.Close()
+		body := `{"a":"` + string(bytes.Repeat([]byte("x"), 1024)) + `"}`
+		send(tap, "application/json", body)
+		require.Equal(t, "signer=1;signature="+sign(sha256.New, body), gotSignature)
+	})
+	t.Run("Unsigned Content-Type", func(t *testing.T) {
+		tap := newTap("", 0)
+		defer tap.Close()
+		send(tap, "text/plain", "Hello")
+		require.Equal(t, "signer=1;signature=x", gotSignature)
+	})
+	t.Run("Without body", func(t *testing.T) {
+		tap := newTap("", 0)
+		defer tap.Close()
+		send(tap, "application/json", "")
+		require.Equal(t, "signer=1;signature=x", gotSignature)
+	})
+}
+
+func TestVerifyInboundSignature(t *testing.T) {
+	const key = "deadbeef"
+	const inboundKey = "cafebabe"
+
+	sign := func(key, body string) string {
+		keyBytes, err := hex.DecodeString(key)
+		require.NoError(t, err)
+		mac := hmac.New(md5.New, keyBytes)
+		mac.Write([]byte(body))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+
+	var requests int
+	var gotSignature, gotAPIKey string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		gotSignature = r.Header.Get("Content-Signature")
+		gotAPIKey = r.Header.Get("Api-Key")
+	}))
+	defer server.Close()
+
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	tap, err := New(Config{
+		TalonAPI: server.URL,
+		Logger:   logger,
+		Application: map[string]*ApplicationConfig{
+			"1": &ApplicationConfig{
+				CalculateHMAC:          true,
+				ApplicationKey:         key,
+				VerifyInboundSignature: true,
+				InboundApplicationKey:  inboundKey,
+				ApplicationToken:       "secret",
+			},
+		},
+	})
+	require.NoError(t, err)
+	defer tap.Close()
+
+	send := func(signature, body string) int {
+		r := httptest.NewRequest(http.MethodPut, "/v1/customer_sessions/1", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("X-TAP-Application", "1")
+		if len(signature) > 0 {
+			r.Header.Set("Content-Signature", signature)
+		}
+		w := httptest.NewRecorder()
+		tap.Handler().ServeHTTP(w, r)
+		return w.Code
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		requests = 0
+		require.Equal(t, http.StatusOK, send("signer=1;signature="+sign(inboundKey, `{"a":1}`), `{"a":1}`))
+		require.Equal(t, 1, requests)
+		require.Equal(t, "signer=1;signature="+sign(key, `{"a":1}`), gotSignature)
+	})
+	t.Run("Invalid", func(t *testing.T) {
+		requests = 0
+		require.Equal(t, http.StatusUnauthorized, send("signer=1;signature="+sign(inboundKey, `{"a":1}`), `{"a":2}`))
+		require.Equal(t, http.StatusUnauthorized, send("signer=1;signature="+sign(key, `{"a":1}`), `{"a":1}`))
+		require.Equal(t, 0, requests)
+	})
+	t.Run("Missing", func(t *testing.T) {
+		requests = 0
+		require.Equal(t, http.StatusUnauthorized, send("signer=1", `{"a":1}`))
+		require.Equal(t, 0, requests)
+	})
+	t.Run("Without body", func(t *testing.T) {
+		requests = 0
+		r := httptest.NewRequest(http.MethodGet, "/v1/customer_sessions/1", nil)
+		r.Header.Set("X-TAP-Application", "1")
+		w := httptest.NewRecorder()
+		tap.Handler().ServeHTTP(w, r)
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+		require.Equal(t, http.StatusUnauthorized, send("", ""))
+		require.Equal(t, http.StatusUnauthorized, send("signer=1", ""))
+		// the credentials of the application are never sent for unverified requests
+		require.Equal(t, 0, requests)
+
+		// the client signs the empty body
+		require.Equal(t, http.StatusOK, send("signer=1;signature="+sign(inboundKey, ""), ""))
+		require.Equal(t, 1, requests)
+		require.Empty(t, gotSignature)
+		require.Equal(t, "application=1.token=secret", gotAPIKey)
+	})
+
+}
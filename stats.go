@@ -0,0 +1,25 @@
+package talon_access_proxy
+
+import "sync/atomic"
+
+// Stats contains counters of a Tap instance
+type Stats struct {
+	// CoalescedRequests is the number of requests that were answered with the response of an identical request
+	CoalescedRequests uint64
+	// CoalesceFallbacks is the number of requests that waited for an identical request and were sent on their own,
+	// because the client of the identical request went away or had a shorter timeout
+	CoalesceFallbacks uint64
+}
+
+type stats struct {
+	coalescedRequests uint64
+	coalesceFallbacks uint64
+}
+
+// Stats returns a snapshot of the counters
+func (t *Tap) Stats() Stats {
+	return Stats{
+		CoalescedRequests: atomic.LoadUint64(&t.stats.coalescedRequests),
+		CoalesceFallbacks: atomic.LoadUint64(&t.stats.coalesceFallbacks),
+	}
+}
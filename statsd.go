@@ -0,0 +1,219 @@
+package talon_access_proxy
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// maxTimingSamples is the number of timing values per metric that are kept between two flushes,
+// if there are more the values are sent with a sample rate
+const maxTimingSamples = 1000
+
+type statsdTiming struct {
+	values []float64
+	count  int
+}
+
+// statsdClient aggregates metrics and sends them periodically to a StatsD or DogStatsD agent
+type statsdClient struct {
+	config *StatsDConfig
+	logger *zap.Logger
+	conn   net.Conn
+
+	mu       sync.Mutex
+	counters map[string]float64
+	gauges   map[string]float64
+	timings  map[string]*statsdTiming
+	// previous values of counters that are read when flushing
+	collected map[string]float64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newStatsdClient(config *StatsDConfig, logger *zap.Logger) (*statsdClient, error) {
+	conn, err := net.Dial("udp", config.Address)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdClient{
+		config:    config,
+		logger:    logger.With(zap.String("tag", "StatsD")),
+		conn:      conn,
+		counters:  make(map[string]float64),
+		gauges:    make(map[string]float64),
+		timings:   make(map[string]*statsdTiming),
+		collected: make(map[string]float64),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}, nil
+}
+
+// name returns the StatsD name of a Prometheus metric, e.g. tap_requests_total becomes tap.requests
+func (c *statsdClient) name(metric string) string {
+	metric = strings.TrimPrefix(metric, "tap_")
+	for _, suffix := range []string{"_total", "_seconds"} {
+		metric = strings.TrimSuffix(metric, suffix)
+	}
+	return c.config.Prefix + metric
+}
+
+var statsdTagReplacer = strings.NewReplacer(",", "_", "|", "_", "#", "_", "\n", "_")
+
+// key returns the aggregation key, it is the metric name followed by the tags
+func (c *statsdClient) key(name string, labels, labelValues []string) string {
+	if !c.config.Tags {
+		return name
+	}
+	var tags []string
+	for i, label := range labels {
+		tags = append(tags, label+":"+statsdTagReplacer.Replace(labelValues[i]))
+	}
+	tags = append(tags, c.config.GlobalTags...)
+	if len(tags) <= 0 {
+		return name
+	}
+	return name + "|#" + strings.Join(tags, ",")
+}
+
+// Count adds v to a counter
+func (c *statsdClient) Count(m *metric, v float64, labelValues []string) {
+	key := c.key(c.name(m.name), m.labels, labelValues)
+	c.mu.Lock()
+	c.counters[key] += v
+	c.mu.Unlock()
+}
+
+// Gauge sets a gauge
+func (c *statsdClient) Gauge(m *metric, v float64, labelValues []string) {
+	key := c.key(c.name(m.name), m.labels, labelValues)
+	c.mu.Lock()
+	c.gauges[key] = v
+	c.mu.Unlock()
+}
+
+// Timing records a duration in seconds
+func (c *statsdClient) Timing(m *metric, seconds float64, labelValues []string) {
+	key := c.key(c.name(m.name), m.labels, labelValues)
+	c.mu.Lock()
+	timing, ok := c.timings[key]
+	if !ok {
+		timing = &statsdTiming{}
+		c.timings[key] = timing
+	}
+	timing.count++
+	if len(timing.values) < maxTimingSamples {
+		timing.values = append(timing.values, seconds*1000)
+	}
+	c.mu.Unlock()
+}
+
+// collect reads the metrics whose values are read on demand, counters are sent as the difference to the last flush
+func (c *statsdClient) collect(r *registry) {
+	for _, m := range r.metrics {
+		if m.collect == nil {
+			continue
+		}
+		for _, s := range m.snapshot() {
+			if m.kind == gaugeMetric {
+				c.Gauge(m, s.value, s.labelValues)
+				continue
+			}
+			key := c.key(c.name(m.name), m.labels, s.labelValues)
+			c.mu.Lock()
+			if delta := s.value - c.collected[key]; delta > 0 {
+				c.counters[key] += delta
+			}
+			c.collected[key] = s.value
+			c.mu.Unlock()
+		}
+	}
+}
+
+// Run flushes the metrics every FlushInterval until Close is called
+func (c *statsdClient) Run(r *registry) {
+	defer close(c.done)
+	ticker := time.NewTicker(c.config.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.collect(r)
+			c.flush()
+		case <-c.stop:
+			c.collect(r)
+			c.flush()
+			return
+		}
+	}
+}
+
+// Close flushes the remaining metrics and stops Run
+func (c *statsdClient) Close() {
+	close(c.stop)
+	<-c.done
+	c.conn.Close()
+}
+
+// flush sends all aggregated metrics, lines are packed into packets of at most MaxPacketSize bytes
+func (c *statsdClient) flush() {
+	c.mu.Lock()
+	var lines []string
+	for key, v := range c.counters {
+		lines = append(lines, statsdLine(key, formatFloat(v), "c", 1))
+	}
+	for key, v := range c.gauges {
+		lines = append(lines, statsdLine(key, formatFloat(v), "g", 1))
+	}
+	for key, timing := range c.timings {
+		rate := float64(len(timing.values)) / float64(timing.count)
+		for _, v := range timing.values {
+			lines = append(lines, statsdLine(key, strconv.FormatFloat(v, 'f', 3, 64), "ms", rate))
+		}
+	}
+	c.counters = make(map[string]float64)
+	c.timings = make(map[string]*statsdTiming)
+	c.mu.Unlock()
+
+	sort.Strings(lines)
+	var packet bytes.Buffer
+	send := func() {
+		if packet.Len() <= 0 {
+			return
+		}
+		if _, err := c.conn.Write(packet.Bytes()); err != nil {
+			c.logger.Debug("Unable to send metrics", zap.Error(err))
+		}
+		packet.Reset()
+	}
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > c.config.MaxPacketSize {
+			send()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	send()
+}
+
+// statsdLine formats a metric, key is the name optionally followed by the tags
+func statsdLine(key, value, kind string, rate float64) string {
+	name, tags := key, ""
+	if i := strings.Index(key, "|#"); i >= 0 {
+		name, tags = key[:i], key[i:]
+	}
+	line := name + ":" + value + "|" + kind
+	if rate < 1 {
+		line += "|@" + strconv.FormatFloat(rate, 'f', 4, 64)
+	}
+	return line + tags
+}
@@ -0,0 +1,78 @@
+package talon_access_proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestStatsdLine(t *testing.T) {
+	require.Equal(t, "tap.requests:1|c|#status:200", statsdLine("tap.requests|#status:200", "1", "c", 1))
+	require.Equal(t, "tap.request_duration:1.500|ms|@0.5000", statsdLine("tap.request_duration", "1.500", "ms", 0.5))
+}
+
+func TestStatsD(t *testing.T) {
+	agent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer agent.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	tap, err := New(Config{
+		TalonAPI: server.URL,
+		Logger:   logger,
+		Metrics:  &MetricsConfig{},
+		StatsD: &StatsDConfig{
+			Address:       agent.LocalAddr().String(),
+			Tags:          true,
+			GlobalTags:    []string{"env:test"},
+			FlushInterval: "1h",
+			MaxPacketSize: 512,
+		},
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		tap.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/campaigns", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+	// Close flushes the metrics
+	tap.Close()
+
+	var lines []string
+	buffer := make([]byte, 65536)
+	for {
+		agent.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := agent.ReadFrom(buffer)
+		if err != nil {
+			break
+		}
+		require.True(t, n <= 512)
+		lines = append(lines, strings.Split(string(buffer[:n]), "\n")...)
+	}
+	sort.Strings(lines)
+
+	require.Contains(t, lines, `tap.requests:3|c|#application:,method:GET,path:/v1/campaigns,status:200,env:test`)
+	require.Contains(t, lines, `tap.upstream_requests:3|c|#upstream:`+server.Listener.Addr().String()+`,status:200,env:test`)
+	require.Contains(t, lines, `tap.upstream_requests_in_flight:0|g|#upstream:`+server.Listener.Addr().String()+`,env:test`)
+	require.Contains(t, lines, `tap.requests_in_flight:0|g|#env:test`)
+	var timings int
+	for _, line := range lines {
+		if strings.HasPrefix(line, "tap.request_duration:") {
+			require.Contains(t, line, "|ms|#application:,method:GET,path:/v1/campaigns,env:test")
+			timings++
+		}
+	}
+	require.Equal(t, 3, timings)
+}
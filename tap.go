@@ -1,25 +1,19 @@
 package talon_access_proxy
 
 import (
-	"bytes"
-	"crypto/hmac"
-	"crypto/md5"
-	"encoding/hex"
+	"context"
 	"errors"
 	"fmt"
-	"hash/crc32"
-	"io"
-	"io/ioutil"
 	"net"
 	"net/http"
-	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/asaskevich/govalidator"
 	"github.com/miekg/dns"
 	"github.com/talon-one/talon-access-proxy/dnscache"
 	"go.uber.org/zap"
-	"go.uber.org/zap/zapcore"
 )
 
 //go:generate go run generate.go
@@ -33,18 +27,50 @@ var Version = "Unknown/CustomBuild"
 // BuildDate represents the build date of talon-access-proxy
 var BuildDate = "Unknown/CustomBuild"
 
+// talonRequestIDHeader is the header the Talon API sends its request id in
+const talonRequestIDHeader = "X-Request-Id"
+
 // Tap implements the talon-access-proxy functionality
 type Tap struct {
-	Config   Config
-	mux      *mux
-	dnscache *dnscache.DNSCache
-	client   http.Client
+	Config     Config
+	mux        *mux
+	dnscache   *dnscache.DNSCache
+	client     http.Client
+	transport  *http.Transport
+	management *management
+	upstreams  upstreams
+	// retryBudget limits the amount of retries
+	retryBudget *retryBudget
+	breakers    *circuitBreakers
+	throttler   *throttler
+	limiter     *concurrencyLimiter
+	// rateLimiters holds the token buckets of the applications with RateLimits
+	rateLimiters map[string]*rateLimiter
+	cache        *responseCache
+	coalescer    *coalescer
+	stats        stats
+	draining     int32
+	instruments  *instruments
+	statsd       *statsdClient
+	tracer       *tracer
+	accessLog    *accessLog
+	// metricsServer serves the metrics on Metrics.Address
+	metricsServer *http.Server
+
+	// lifecycle, inflight counts the requests that are being served
+	mu        sync.Mutex
+	closed    bool
+	inflight  int
+	idle      chan struct{}
+	closeOnce sync.Once
+	// wg tracks background goroutines
+	wg sync.WaitGroup
 
 	logger *zap.Logger
 }
 
 // New creates a new instance of the Tap type
-func New(config Config) (*Tap, error) {
+func New(config Config) (_ *Tap, err error) {
 	// make sure the config is valid
 	if err := config.SetDefaults(); err != nil {
 		return nil, err
@@ -52,28 +78,103 @@ func New(config Config) (*Tap, error) {
 	// create a tap instance
 	t := &Tap{
 		Config: config,
+		idle:   make(chan struct{}),
 		logger: config.Logger.With(zap.String("tag", "Tap")),
 	}
+	// release what was opened so far if New fails, the background goroutines are started last
+	defer func() {
+		if err == nil {
+			return
+		}
+		if t.dnscache != nil {
+			t.dnscache.Close()
+		}
+		if t.statsd != nil {
+			t.statsd.conn.Close()
+		}
+		t.accessLog.Close()
+	}()
 	// create an http mux instance that handles incoming requests
 	t.mux = newMux(t)
 
-	t.dnscache = dnscache.New(config.Logger.With(zap.String("tag", "DNSCache")))
+	if t.Config.Management != nil {
+		t.management = newManagement(t)
+	}
+
+	t.retryBudget = newRetryBudget(t.Config.Retry.Budget, t.Config.Retry.BudgetBurst)
+
+	if t.Config.CircuitBreaker != nil {
+		t.breakers = newCircuitBreakers(t.Config.CircuitBreaker, t.Config.Logger)
+	}
+
+	if t.Config.Concurrency != nil {
+		t.limiter = newConcurrencyLimiter(t.Config.Concurrency, t.Config.Logger)
+	}
+
+	t.rateLimiters = make(map[string]*rateLimiter)
+	for id, app := range t.Config.Application {
+		if len(app.RateLimits) > 0 {
+			t.rateLimiters[id] = newRateLimiter(app.RateLimits)
+		}
+	}
+
+	if t.Config.Throttle != nil {
+		t.throttler = newThrottler(t.Config.Throttle, t.Config.Logger)
+	}
+
+	if t.Config.Cache != nil {
+		t.cache = newResponseCache(t.Config.Cache, t.Config.Logger)
+	}
+
+	if t.Config.Coalesce != nil {
+		t.coalescer = newCoalescer(t)
+	}
 
-	// make sure talonHost has no port in it
-	talonHost := t.Config.talonAPIUrl.Hostname()
+	t.dnscache = dnscache.New(config.Logger.With(zap.String("tag", "DNSCache")))
 
-	// if the talon service is a hostname, resolve it
-	if govalidator.IsDNSName(talonHost) {
-		err := t.dnscache.ResolveAndAdd(t.Config.DNSServer, "udp", talonHost, dns.ClassINET, dns.TypeA)
+	if t.Config.StatsD != nil {
+		var err error
+		t.statsd, err = newStatsdClient(t.Config.StatsD, t.Config.Logger)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("Unable to connect to StatsD.Address: %s", err.Error())
 		}
-		err = t.dnscache.ResolveAndAdd(t.Config.DNSServer, "udp", talonHost, dns.ClassINET, dns.TypeAAAA)
+	}
+
+	if t.Config.Tracing != nil {
+		t.tracer = newTracer(t.Config.Tracing, t.Config.Logger)
+	}
+
+	if t.Config.AccessLog != nil {
+		var err error
+		t.accessLog, err = newAccessLog(t.Config.AccessLog, t.Config.Logger)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("Unable to open AccessLog.Path: %s", err.Error())
 		}
-	} else if !govalidator.IsIP(talonHost) {
-		return nil, errors.New("TalonURL does not contain a valid host part")
+	}
+
+	if t.Config.Metrics != nil || t.statsd != nil {
+		t.instruments = newInstruments(t, t.statsd)
+	}
+
+	for _, u := range t.Config.upstreams {
+		// make sure talonHost has no port in it
+		talonHost := u.Hostname()
+
+		// if the talon service is a hostname, resolve it
+		if govalidator.IsDNSName(talonHost) {
+			err := t.dnscache.ResolveAndAdd(t.Config.DNSServer, "udp", talonHost, dns.ClassINET, dns.TypeA)
+			if err != nil {
+				return nil, err
+			}
+			err = t.dnscache.ResolveAndAdd(t.Config.DNSServer, "udp", talonHost, dns.ClassINET, dns.TypeAAAA)
+			if err != nil {
+				return nil, err
+			}
+		} else if !govalidator.IsIP(talonHost) {
+			return nil, errors.New("TalonURL does not contain a valid host part")
+		}
+
+		t.upstreams = append(t.upstreams, newUpstream(u, &t.Config.Failover, t.logger))
 	}
 
 	if err := t.dnscache.Server(); err != nil {
@@ -81,7 +182,7 @@ func New(config Config) (*Tap, error) {
 	}
 
 	// create http client
-	t.client.Transport = &http.Transport{
+	t.transport = &http.Transport{
 		Proxy: http.ProxyFromEnvironment,
 		DialContext: (&net.Dialer{
 			Timeout:   30 * time.Second,
@@ -94,6 +195,41 @@ func New(config Config) (*Tap, error) {
 		TLSHandshakeTimeout:   10 * time.Second,
 		ExpectContinueTimeout: 1 * time.Second,
 	}
+	t.client.Transport = t.transport
+
+	if t.Config.Metrics != nil && len(t.Config.Metrics.Address) > 0 {
+		listener, err := net.Listen("tcp", t.Config.Metrics.Address)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to listen on Metrics.Address: %s", err.Error())
+		}
+		mux := http.NewServeMux()
+		mux.Handle(t.Config.Metrics.Path, t.MetricsHandler())
+		t.metricsServer = &http.Server{Handler: mux}
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			t.logger.Info("Serving metrics", zap.String("address", listener.Addr().String()), zap.String("path", t.Config.Metrics.Path))
+			if err := t.metricsServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+				t.logger.Error("Metrics server failed", zap.Error(err))
+			}
+		}()
+	}
+
+	if t.statsd != nil {
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			t.statsd.Run(&t.instruments.registry)
+		}()
+	}
+
+	if t.tracer != nil {
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			t.tracer.Run()
+		}()
+	}
 
 	return t, nil
 }
@@ -103,114 +239,228 @@ func (t *Tap) Handler() http.Handler {
 	return t.mux
 }
 
-// Close the tap instance
+// MetricsHandler returns an http.Handler that serves the metrics in the Prometheus text format,
+// it responds with 404 if metrics are disabled
+func (t *Tap) MetricsHandler() http.Handler {
+	if t.Config.Metrics == nil {
+		return http.NotFoundHandler()
+	}
+	return &t.instruments.registry
+}
+
+// Drain marks the instance as not ready, /.ready responds with 503 from now on
+// so load balancers stop sending new requests, in-flight and new requests are still served
+func (t *Tap) Drain() {
+	if atomic.CompareAndSwapInt32(&t.draining, 0, 1) {
+		t.logger.Info("Draining")
+	}
+}
+
+// Ready reports whether the instance accepts new requests
+func (t *Tap) Ready() bool {
+	if atomic.LoadInt32(&t.draining) != 0 {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return !t.closed
+}
+
+// Shutdown stops accepting requests and waits until all in-flight requests are done or ctx is done,
+// then it stops the DNSCache server, waits for background goroutines and closes idle upstream connections.
+// Requests after Shutdown are answered with 503. It is safe to call Shutdown and Close multiple times.
+func (t *Tap) Shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		if t.inflight == 0 {
+			close(t.idle)
+		}
+	}
+	t.mu.Unlock()
+
+	select {
+	case <-t.idle:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	t.closeOnce.Do(func() {
+		if t.metricsServer != nil {
+			t.metricsServer.Close()
+		}
+		if t.statsd != nil {
+			t.statsd.Close()
+		}
+		if t.tracer != nil {
+			t.tracer.Close()
+		}
+		t.dnscache.Close()
+		t.wg.Wait()
+		t.accessLog.Close()
+		t.transport.CloseIdleConnections()
+		t.logger.Debug("Closed")
+	})
+	return nil
+}
+
+// Close the tap instance, it waits for in-flight requests and releases all resources, see Shutdown
 func (t *Tap) Close() {
+	t.Shutdown(context.Background())
+}
+
+// acquire registers an in-flight request, it returns false if the instance is closed
+func (t *Tap) acquire() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return false
+	}
+	t.inflight++
+	return true
+}
+
+// release unregisters an in-flight request
+func (t *Tap) release() {
+	t.mu.Lock()
+	t.inflight--
+	if t.closed && t.inflight == 0 {
+		close(t.idle)
+	}
+	t.mu.Unlock()
 }
 
 func (t *Tap) doHTTPRequest(r *http.Request) (*http.Response, error) {
-	r.URL.Host = t.Config.talonAPIUrl.Host
-	r.URL.Scheme = t.Config.talonAPIUrl.Scheme
-	req := http.Request{
+	active := t.upstreams.Active()
+	r.URL.Host = active.url.Host
+	r.URL.Scheme = active.url.Scheme
+	header, err := t.forwardHeaders(r)
+	if err != nil {
+		return nil, err
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = clientBody{r.Body}
+	}
+	info := getRequestInfo(r.Context())
+	header.Set(t.Config.RequestIDHeader, info.ID)
+	header.Del(debugHeader)
+	if value := header.Get("X-TAP-Timeout"); len(value) > 0 {
+		if info.Timeout, err = parseClientTimeout(value); err != nil {
+			return nil, err
+		}
+		header.Del("X-TAP-Timeout")
+	}
+	req := (&http.Request{
 		Method:        r.Method,
 		URL:           r.URL,
-		Header:        r.Header,
+		Header:        header,
 		Body:          r.Body,
 		ContentLength: r.ContentLength,
 		Close:         false,
-	}
-
-	req.Header.Set("X-TAP", Version)
+	}).WithContext(withRequestInfo(r.Context(), info))
 
-	logger := t.logger
+	logger := info.Debug.wrap(t.logger.With(zap.String("requestId", info.ID)))
+	if info.Span != nil {
+		logger = logger.With(zap.String("traceId", info.Span.TraceID()))
+	}
 
-	if t.logger.Core().Enabled(zap.DebugLevel) {
-		logger = logger.With(zap.Uint32("id", crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s-%s-%d-%d", req.Method, req.URL.String(), req.ContentLength, time.Now().Unix())))))
-		logger.Debug("Performing Request", zap.String("method", req.Method), zap.String("url", req.URL.String()), zap.Int64("content-length", req.ContentLength), zap.Any("header", req.Header))
+	if logger.Core().Enabled(zap.DebugLevel) {
+		logger.Debug("Performing Request", zap.String("method", req.Method), zap.String("url", req.URL.String()), zap.Int64("content-length", req.ContentLength), zap.Any("header", t.Config.Redaction.header(req.Header)))
 	}
 
-	if len(t.Config.Application) > 0 {
-		if err := t.applicationSpecificHeaders(logger, r, &req); err != nil {
-			logger.Debug("Request got error", zap.String("error", err.Error()))
-			return nil, err
+	do := t.roundTripper(logger)
+
+	var res *http.Response
+	if t.management != nil && t.management.Match(req) {
+		res, err = t.management.Do(logger, req, do)
+	} else {
+		if len(t.Config.Application) > 0 {
+			if err := t.applicationSpecificHeaders(logger, r, req); err != nil {
+				logger.Debug("Request got error", zap.String("error", err.Error()))
+				return nil, err
+			}
 		}
+		res, err = do(req)
+	}
+	releaseRequestBody(req)
+	// the request might have failed over to another upstream
+	if len(info.Upstream) > 0 {
+		logger = logger.With(zap.String("upstream", info.Upstream))
 	}
-
-	res, err := t.client.Do(&req)
 	if err != nil {
 		logger.Debug("Request got error", zap.String("error", err.Error()))
 	} else {
-		logger.Debug("Request succeeded",
-			zap.Int("statusCode", res.StatusCode),
-			zap.Int64("content-length", res.ContentLength),
-			zap.Any("header", res.Header),
-		)
+		if id := res.Header.Get(talonRequestIDHeader); len(id) > 0 && id != info.ID && !servedFromCache(res) {
+			info.TalonRequestID = id
+			logger = logger.With(zap.String("talonRequestId", id))
+		}
+		if logger.Core().Enabled(zap.DebugLevel) {
+			logger.Debug("Request succeeded",
+				zap.Int("statusCode", res.StatusCode),
+				zap.Int64("content-length", res.ContentLength),
+				zap.Any("header", t.Config.Redaction.header(res.Header)),
+			)
+		}
 	}
 
 	return res, err
 }
 
-func extractApplicationID(r *http.Request) string {
-	if header := r.Header.Get("Api-Key"); len(header) > 0 {
-		fields := strings.Split(header, ".")
-		for _, field := range fields {
-			tokens := strings.Split(field, "=")
-			if len(tokens) < 2 {
-				return ""
-			}
-			if strings.TrimSpace(tokens[0]) == "application" {
-				return strings.TrimSpace(tokens[1])
-			}
+// roundTripFunc sends a request upstream
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+// roundTripper chains all layers a request passes on its way upstream
+func (t *Tap) roundTripper(logger *zap.Logger) roundTripFunc {
+	do := func(req *http.Request) (*http.Response, error) {
+		return t.retryRoundTrip(logger, req)
+	}
+	if t.throttler != nil {
+		next := do
+		do = func(req *http.Request) (*http.Response, error) {
+			return t.throttledRoundTrip(logger, req, next)
 		}
 	}
-
-	if header := r.Header.Get("Content-Signature"); len(header) > 0 {
-		fields := strings.Split(header, ";")
-		for _, field := range fields {
-			tokens := strings.Split(field, "=")
-			if len(tokens) < 2 {
-				return ""
-			}
-			if strings.TrimSpace(tokens[0]) == "signer" {
-				return strings.TrimSpace(tokens[1])
-			}
+	if t.cache != nil {
+		next := do
+		do = func(req *http.Request) (*http.Response, error) {
+			return t.cachedRoundTrip(logger, req, next)
 		}
 	}
-	return ""
+	if t.coalescer != nil {
+		next := do
+		do = func(req *http.Request) (*http.Response, error) {
+			return t.coalescer.Do(logger, req, next)
+		}
+	}
+	next := do
+	return func(req *http.Request) (*http.Response, error) {
+		return t.timeoutRoundTrip(logger, req, next)
+	}
 }
 
 func (t *Tap) applicationSpecificHeaders(logger *zap.Logger, incomingRequest, outgoingRequest *http.Request) error {
-	appID := extractApplicationID(incomingRequest)
-	if len(appID) <= 0 {
-		return nil
+	id, config := t.Config.resolveApplication(incomingRequest)
+	if len(t.Config.ApplicationHeader) > 0 {
+		outgoingRequest.Header.Del(t.Config.ApplicationHeader)
 	}
-	for id, config := range t.Config.Application {
-		if !strings.EqualFold(id, appID) {
-			continue
-		}
-		if config.CalculateHMAC && incomingRequest.Body != nil && strings.EqualFold(incomingRequest.Header.Get("Content-Type"), "application/json") {
-			logger.Debug("Calculating HMAC")
-			mac := hmac.New(md5.New, config.applicationKeyBytes)
-			// copy the body
-			var buffer bytes.Buffer
-			w := io.MultiWriter(&buffer, mac)
-			if _, err := io.Copy(w, incomingRequest.Body); err != nil {
-				return err
-			}
-
-			if logger.Core().Enabled(zapcore.DebugLevel) {
-				logger.Debug("Copied body", zap.ByteString("body", buffer.Bytes()))
-			}
-
-			signature := hex.EncodeToString(mac.Sum(nil))
-			outgoingRequest.Header.Set("Content-Signature", fmt.Sprintf("signer=%s;signature=%s", id, signature))
-			logger.Debug("HMAC Calculated", zap.String("signer", id), zap.String("signature", signature))
-			outgoingRequest.Body = ioutil.NopCloser(&buffer)
-		}
-		if len(config.ApplicationToken) > 0 {
-			logger.Debug("Adding Api-Key to request")
-			outgoingRequest.Header.Set("Api-Key", fmt.Sprintf("application=%s.token=%s", id, config.ApplicationToken))
-		}
+	if config == nil {
 		return nil
 	}
+	getRequestInfo(outgoingRequest.Context()).ApplicationID = id
+	// verify the inbound signature before any credentials of the application are added
+	if err := t.signRequest(logger, id, config, incomingRequest, outgoingRequest); err != nil {
+		return err
+	}
+	if err := t.rateLimit(logger, id, incomingRequest, outgoingRequest); err != nil {
+		return err
+	}
+	if len(config.ApplicationToken) > 0 {
+		logger.Debug("Adding Api-Key to request")
+		outgoingRequest.Header.Set("Api-Key", fmt.Sprintf("application=%s.token=%s", id, config.ApplicationToken))
+	}
+	if len(config.APIKey) > 0 {
+		logger.Debug("Adding Authorization to request")
+		outgoingRequest.Header.Set("Authorization", "ApiKey-v1 "+config.APIKey)
+	}
 	return nil
 }
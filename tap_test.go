@@ -1,9 +1,11 @@
 package talon_access_proxy
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/valyala/fasthttp"
@@ -35,3 +37,55 @@ func BenchmarkTap(b *testing.B) {
 		require.Equal(b, http.StatusNotFound, statusCode)
 	}
 }
+
+func TestShutdown(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	defer server.Close()
+
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	tap, err := New(Config{
+		TalonAPI: server.URL,
+		Logger:   logger,
+	})
+	require.NoError(t, err)
+
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		tap.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+	send := func() int {
+		return get("/v1/campaigns")
+	}
+
+	status := make(chan int, 1)
+	go func() {
+		status <- send()
+	}()
+	<-started
+
+	// the in-flight request is still running
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, tap.Shutdown(ctx))
+	require.False(t, tap.Ready())
+	require.Equal(t, http.StatusServiceUnavailable, send())
+	// health checks are still answered
+	require.Equal(t, http.StatusOK, get("/.health"))
+	require.Equal(t, http.StatusServiceUnavailable, get("/.ready"))
+
+	close(release)
+	require.Equal(t, http.StatusOK, <-status)
+	require.NoError(t, tap.Shutdown(context.Background()))
+	require.Empty(t, tap.dnscache.Addr())
+
+	// closing again is a no-op
+	tap.Close()
+	require.Equal(t, http.StatusServiceUnavailable, send())
+}
@@ -0,0 +1,287 @@
+package talon_access_proxy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// throttledError is returned when a request is not sent because the Talon API is throttling its endpoint
+type throttledError struct {
+	retryAfter time.Duration
+}
+
+func (e *throttledError) Error() string {
+	return fmt.Sprintf("Talon API is throttling requests, retry after %s", e.retryAfter)
+}
+
+// collectionSegment matches the collection segments of a Talon API path
+var collectionSegment = regexp.MustCompile(`^[a-z][a-z_]{0,63}$`)
+
+// routeShape collapses the ids of a path, e.g. /v1/loyalty_programs/1/profile/a/points becomes
+// /v1/loyalty_programs/:id/profile/:id/points. Unlike normalizePath it is not limited to the known routes,
+// so every endpoint is throttled on its own.
+func routeShape(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i := 1; i < len(segments); i++ {
+		// Talon API paths alternate between collections and ids
+		if i%2 == 0 || !collectionSegment.MatchString(segments[i]) {
+			segments[i] = ":id"
+		}
+	}
+	return "/" + strings.Join(segments, "/")
+}
+
+// throttleKey identifies an endpoint of an application
+type throttleKey struct {
+	application string
+	method      string
+	path        string
+}
+
+// throttleState is the state of a throttled endpoint
+type throttleState struct {
+	// Rate is the number of requests per second that are sent
+	Rate float64
+	// CoolDown is the remaining time no requests are sent
+	CoolDown time.Duration
+}
+
+// throttleEntry learns the rate limit of an endpoint from 429 responses.
+// A 429 stops all requests until the Retry-After passed and decreases the rate,
+// every second without 429 increases it again, after Reset the endpoint is no longer throttled.
+type throttleEntry struct {
+	// rate is the number of requests per second that are sent, 0 if the endpoint is not throttled
+	rate float64
+	// until is the end of the cool-down
+	until time.Time
+	// next is the time the next request may be sent at
+	next time.Time
+	// lastThrottled is the time of the last 429, increased the time the rate was last increased
+	lastThrottled time.Time
+	increased     time.Time
+	// requests of the current and the previous second, they estimate the rate before the first 429
+	windowStart   time.Time
+	requests      int
+	previousCount int
+}
+
+// reserve returns the delay until a request may be sent, ok is false if it exceeds maxWait, no slot is taken in that case
+func (e *throttleEntry) reserve(now time.Time, maxWait time.Duration) (time.Duration, bool) {
+	if d := now.Sub(e.windowStart); d >= time.Second {
+		e.previousCount = 0
+		if d < 2*time.Second {
+			e.previousCount = e.requests
+		}
+		e.windowStart = now
+		e.requests = 0
+	}
+	e.requests++
+
+	slot := now
+	if e.until.After(slot) {
+		slot = e.until
+	}
+	if e.rate > 0 && e.next.After(slot) {
+		slot = e.next
+	}
+	delay := slot.Sub(now)
+	if delay > maxWait {
+		return delay, false
+	}
+	if e.rate > 0 {
+		e.next = slot.Add(time.Duration(float64(time.Second) / e.rate))
+	}
+	return delay, true
+}
+
+// throttled records a 429 response
+func (e *throttleEntry) throttled(now time.Time, retryAfter time.Duration, config *ThrottleConfig) {
+	// the responses of requests that were sent together count as one 429
+	coolingDown := now.Before(e.until)
+	if until := now.Add(retryAfter); until.After(e.until) {
+		e.until = until
+	}
+	if e.rate <= 0 {
+		e.rate = float64(e.requests)
+		if e.previousCount > e.requests {
+			e.rate = float64(e.previousCount)
+		}
+		coolingDown = false
+	}
+	if !coolingDown {
+		e.rate = math.Max(config.MinRate, e.rate*config.Decrease)
+	}
+	e.lastThrottled = now
+	e.increased = e.until
+}
+
+// succeeded records a response that was not throttled
+func (e *throttleEntry) succeeded(now time.Time, config *ThrottleConfig) {
+	if e.rate <= 0 || now.Before(e.until) {
+		return
+	}
+	if now.Sub(e.lastThrottled) >= config.reset {
+		e.rate = 0
+		return
+	}
+	if elapsed := now.Sub(e.increased); elapsed > 0 {
+		e.rate *= math.Pow(1+config.Increase, elapsed.Seconds())
+		e.increased = now
+	}
+}
+
+// throttler shapes the requests to endpoints that answered 429 Too Many Requests
+type throttler struct {
+	config *ThrottleConfig
+	logger *zap.Logger
+
+	mu        sync.Mutex
+	entries   map[throttleKey]*throttleEntry
+	lastSweep time.Time
+}
+
+func newThrottler(config *ThrottleConfig, logger *zap.Logger) *throttler {
+	return &throttler{
+		config:    config,
+		logger:    logger.With(zap.String("tag", "Throttle")),
+		entries:   make(map[throttleKey]*throttleEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+// Reserve returns the delay until a request to key may be sent, ok is false if it exceeds MaxWait
+func (t *throttler) Reserve(key throttleKey, now time.Time) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now.Sub(t.lastSweep) >= t.config.reset {
+		t.sweep(now)
+	}
+	entry, ok := t.entries[key]
+	if !ok {
+		entry = &throttleEntry{windowStart: now}
+		t.entries[key] = entry
+	}
+	return entry.reserve(now, t.config.maxWait)
+}
+
+// Report learns from the response of a request to key
+func (t *throttler) Report(key throttleKey, res *http.Response, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	entry, ok := t.entries[key]
+	if !ok {
+		return
+	}
+	if res.StatusCode != http.StatusTooManyRequests {
+		entry.succeeded(now, t.config)
+		return
+	}
+	retryAfter, ok := parseRetryAfter(res.Header.Get("Retry-After"), now)
+	if !ok {
+		retryAfter = t.config.defaultRetryAfter
+	}
+	entry.throttled(now, retryAfter, t.config)
+	t.logger.Info("Talon API is throttling requests",
+		zap.String("application", key.application),
+		zap.String("method", key.method),
+		zap.String("path", key.path),
+		zap.Duration("retryAfter", retryAfter),
+		zap.Float64("rate", entry.rate),
+	)
+}
+
+// sweep removes the entries of endpoints that are idle and not throttled (anymore), t.mu must be held
+func (t *throttler) sweep(now time.Time) {
+	for key, entry := range t.entries {
+		if now.Sub(entry.windowStart) < time.Second || entry.until.After(now) {
+			continue
+		}
+		if entry.rate <= 0 || now.Sub(entry.lastThrottled) >= t.config.reset {
+			delete(t.entries, key)
+		}
+	}
+	t.lastSweep = now
+}
+
+// States returns the state of all throttled endpoints
+func (t *throttler) States() map[throttleKey]throttleState {
+	states := make(map[throttleKey]throttleState)
+	if t == nil {
+		return states
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	for key, entry := range t.entries {
+		if entry.rate <= 0 {
+			continue
+		}
+		var coolDown time.Duration
+		if entry.until.After(now) {
+			coolDown = entry.until.Sub(now)
+		}
+		states[key] = throttleState{Rate: entry.rate, CoolDown: coolDown}
+	}
+	return states
+}
+
+// parseRetryAfter parses the value of a Retry-After header, it is either in seconds or a http date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if len(value) <= 0 {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if date.Before(now) {
+		return 0, true
+	}
+	return date.Sub(now), true
+}
+
+// throttledRoundTrip delays or rejects requests to endpoints the Talon API is throttling
+func (t *Tap) throttledRoundTrip(logger *zap.Logger, req *http.Request, next roundTripFunc) (*http.Response, error) {
+	key := throttleKey{
+		application: getRequestInfo(req.Context()).ApplicationID,
+		method:      req.Method,
+		path:        routeShape(req.URL.Path),
+	}
+	delay, ok := t.throttler.Reserve(key, time.Now())
+	if !ok {
+		logger.Debug("Rejecting throttled request", zap.Duration("retryAfter", delay))
+		t.instruments.throttle(key, "rejected")
+		return nil, &throttledError{retryAfter: delay}
+	}
+	if delay > 0 {
+		logger.Debug("Delaying throttled request", zap.Duration("delay", delay))
+		t.instruments.throttle(key, "delayed")
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+
+	res, err := next(req)
+	if err == nil {
+		t.throttler.Report(key, res, time.Now())
+	}
+	return res, err
+}
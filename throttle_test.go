@@ -0,0 +1,187 @@
+package talon_access_proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	d, ok := parseRetryAfter("3", now)
+	require.True(t, ok)
+	require.Equal(t, 3*time.Second, d)
+
+	d, ok = parseRetryAfter("Wed, 01 Jan 2020 00:00:10 GMT", now)
+	require.True(t, ok)
+	require.Equal(t, 10*time.Second, d)
+
+	_, ok = parseRetryAfter("", now)
+	require.False(t, ok)
+	_, ok = parseRetryAfter("-1", now)
+	require.False(t, ok)
+	_, ok = parseRetryAfter("soon", now)
+	require.False(t, ok)
+}
+
+func TestRouteShape(t *testing.T) {
+	require.Equal(t, "/v1/campaigns", routeShape("/v1/campaigns/"))
+	require.Equal(t, "/v1/loyalty_programs/:id/profile/:id/points", routeShape("/v1/loyalty_programs/1/profile/a/points"))
+	require.Equal(t, "/v2/customer_profiles/:id/achievements", routeShape("/v2/customer_profiles/a/achievements"))
+	require.Equal(t, "/v1/:id", routeShape("/v1/Campaigns"))
+}
+
+func TestThrottleEntry(t *testing.T) {
+	config := &ThrottleConfig{}
+	require.NoError(t, config.setDefaults())
+	now := time.Now()
+	e := &throttleEntry{windowStart: now}
+
+	// 8 requests per second before the first 429
+	for i := 0; i < 8; i++ {
+		_, ok := e.reserve(now, 0)
+		require.True(t, ok)
+	}
+	e.throttled(now, 2*time.Second, config)
+	require.Equal(t, float64(4), e.rate)
+	// the responses of the other requests do not decrease the rate again
+	e.throttled(now.Add(time.Millisecond), time.Second, config)
+	require.Equal(t, float64(4), e.rate)
+
+	// no requests until the cool-down is over
+	delay, ok := e.reserve(now.Add(time.Second), 0)
+	require.False(t, ok)
+	require.Equal(t, time.Second, delay)
+	delay, ok = e.reserve(now.Add(time.Second), 2*time.Second)
+	require.True(t, ok)
+	require.Equal(t, time.Second, delay)
+	// afterwards they are spaced out by the rate
+	delay, ok = e.reserve(now.Add(time.Second), 2*time.Second)
+	require.True(t, ok)
+	require.Equal(t, 1250*time.Millisecond, delay)
+
+	// every second without 429 increases the rate
+	e.succeeded(now.Add(3*time.Second), config)
+	require.InDelta(t, 4.4, e.rate, 0.001)
+	e.throttled(now.Add(4*time.Second), time.Second, config)
+	require.InDelta(t, 2.2, e.rate, 0.001)
+	e.throttled(now.Add(6*time.Second), time.Second, config)
+	require.InDelta(t, 1.1, e.rate, 0.001)
+	e.throttled(now.Add(8*time.Second), time.Second, config)
+	require.Equal(t, config.MinRate, e.rate)
+
+	// the endpoint is no longer throttled after Reset
+	e.succeeded(now.Add(8*time.Second+config.reset), config)
+	require.Equal(t, float64(0), e.rate)
+	delay, ok = e.reserve(now.Add(8*time.Second+config.reset), 0)
+	require.True(t, ok)
+	require.Equal(t, time.Duration(0), delay)
+}
+
+func TestThrottle(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			if r.URL.Query().Get("retryAfter") != "" {
+				w.Header().Set("Retry-After", r.URL.Query().Get("retryAfter"))
+			}
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+
+	newTap := func(config *ThrottleConfig) *Tap {
+		atomic.StoreInt32(&requests, 0)
+		tap, err := New(Config{
+			TalonAPI: server.URL,
+			Logger:   logger,
+			Metrics:  &MetricsConfig{},
+			Throttle: config,
+			Application: map[string]*ApplicationConfig{
+				"1": &ApplicationConfig{},
+				"2": &ApplicationConfig{},
+			},
+		})
+		require.NoError(t, err)
+		return tap
+	}
+	send := func(tap *Tap, application, url string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, url, nil)
+		r.Header.Set("X-TAP-Application", application)
+		w := httptest.NewRecorder()
+		tap.Handler().ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("Reject", func(t *testing.T) {
+		tap := newTap(&ThrottleConfig{})
+		defer tap.Close()
+
+		w := send(tap, "1", "/v1/campaigns?retryAfter=30")
+		require.Equal(t, http.StatusTooManyRequests, w.Code)
+		require.Equal(t, "30", w.Header().Get("Retry-After"))
+
+		w = send(tap, "1", "/v1/campaigns")
+		require.Equal(t, http.StatusTooManyRequests, w.Code)
+		require.Equal(t, "throttled", w.Header().Get("X-TAP-Error"))
+		require.Equal(t, "30", w.Header().Get("Retry-After"))
+		require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+		// other applications and endpoints are not throttled
+		require.Equal(t, http.StatusOK, send(tap, "2", "/v1/campaigns").Code)
+		require.Equal(t, http.StatusOK, send(tap, "1", "/v1/coupons").Code)
+
+		w = httptest.NewRecorder()
+		tap.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		metrics := w.Body.String()
+		require.Contains(t, metrics, `tap_throttle_requests_total{application="1",method="GET",path="/v1/campaigns",result="rejected"} 1`)
+		require.Contains(t, metrics, `tap_throttle_rate{application="1",method="GET",path="/v1/campaigns"} 1`)
+		require.Contains(t, metrics, `tap_throttle_cooldown_seconds{application="1",method="GET",path="/v1/campaigns"} 29.`)
+		require.Contains(t, metrics, `tap_errors_total{code="throttled"} 1`)
+	})
+
+	t.Run("Unlisted routes", func(t *testing.T) {
+		tap := newTap(&ThrottleConfig{})
+		defer tap.Close()
+
+		require.Equal(t, http.StatusTooManyRequests, send(tap, "1", "/v1/loyalty_programs/1/profile/a/points?retryAfter=30").Code)
+
+		// the ids of the route are collapsed
+		w := send(tap, "1", "/v1/loyalty_programs/2/profile/b/points")
+		require.Equal(t, http.StatusTooManyRequests, w.Code)
+		require.Equal(t, "throttled", w.Header().Get("X-TAP-Error"))
+
+		// other routes are not throttled, even if they share the path label
+		require.Equal(t, http.StatusOK, send(tap, "1", "/v2/customer_profiles/a/achievements").Code)
+		require.Equal(t, http.StatusOK, send(tap, "1", "/v1/loyalty_programs/1/profile/a").Code)
+
+		w = httptest.NewRecorder()
+		tap.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		require.Contains(t, w.Body.String(), `tap_throttle_requests_total{application="1",method="GET",path="other",result="rejected"} 1`)
+	})
+
+	t.Run("Queue", func(t *testing.T) {
+		tap := newTap(&ThrottleConfig{
+			MaxWait:           "1s",
+			DefaultRetryAfter: "50ms",
+		})
+		defer tap.Close()
+
+		require.Equal(t, http.StatusTooManyRequests, send(tap, "1", "/v1/campaigns").Code)
+		start := time.Now()
+		require.Equal(t, http.StatusOK, send(tap, "1", "/v1/campaigns").Code)
+		require.True(t, time.Since(start) >= 40*time.Millisecond)
+
+		w := httptest.NewRecorder()
+		tap.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		require.Contains(t, w.Body.String(), `tap_throttle_requests_total{application="1",method="GET",path="/v1/campaigns",result="delayed"} 1`)
+	})
+}
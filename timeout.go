@@ -0,0 +1,137 @@
+package talon_access_proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var errInvalidTimeout = errors.New("X-TAP-Timeout is invalid")
+
+// timeoutError is returned when an upstream did not respond in time
+type timeoutError struct {
+	msg string
+}
+
+func (e *timeoutError) Error() string   { return e.msg }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// timeouts returns the total and the time to first byte timeout for requests to path
+func (config *TimeoutConfig) timeouts(path string) (time.Duration, time.Duration) {
+	total, firstByte := config.total, config.firstByte
+	for i := range config.Routes {
+		route := &config.Routes[i]
+		if !matchRoute(route.Path, path) {
+			continue
+		}
+		if len(route.Total) > 0 {
+			total = route.total
+		}
+		if len(route.FirstByte) > 0 {
+			firstByte = route.firstByte
+		}
+		break
+	}
+	return total, firstByte
+}
+
+// parseClientTimeout parses the X-TAP-Timeout header, it is either a duration like `1500ms` or milliseconds
+func parseClientTimeout(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if ms, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if ms <= 0 {
+			return 0, errInvalidTimeout
+		}
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, errInvalidTimeout
+	}
+	return timeout, nil
+}
+
+// timeoutRoundTrip applies the deadline of the route and of the client to req,
+// the deadline is measured from the time the request was received and ends when the response body is closed
+func (t *Tap) timeoutRoundTrip(logger *zap.Logger, req *http.Request, next roundTripFunc) (*http.Response, error) {
+	info := getRequestInfo(req.Context())
+	total, firstByte := t.Config.Timeout.timeouts(req.URL.Path)
+	if info.Timeout > 0 && (total <= 0 || info.Timeout < total) {
+		total = info.Timeout
+	}
+	info.FirstByteTimeout = firstByte
+	if total <= 0 {
+		return next(req)
+	}
+
+	start := info.Start
+	if start.IsZero() {
+		start = time.Now()
+	}
+	logger.Debug("Applying request timeout", zap.Duration("total", total), zap.Duration("firstByte", firstByte))
+	ctx, cancel := context.WithDeadline(req.Context(), start.Add(total))
+	timeoutReq := req.WithContext(ctx)
+	res, err := next(timeoutReq)
+	// the body may have been buffered, so it can be released with req
+	req.Body, req.GetBody = timeoutReq.Body, timeoutReq.GetBody
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res.Body = cancelBody{res.Body, cancel}
+	return res, nil
+}
+
+// send sends req to the upstream, if the response headers do not arrive within firstByte the request is aborted
+func (t *Tap) send(req *http.Request, firstByte time.Duration, span *span) (*http.Response, error) {
+	info := getRequestInfo(req.Context())
+	for _, trace := range []*httptrace.ClientTrace{t.instruments.clientTrace(), span.clientTrace(), info.Debug.clientTrace(), info.Timings.clientTrace()} {
+		if trace != nil {
+			req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+		}
+	}
+	if firstByte <= 0 {
+		return t.client.Do(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	var timedOut int32
+	timer := time.AfterFunc(firstByte, func() {
+		atomic.StoreInt32(&timedOut, 1)
+		cancel()
+	})
+	res, err := t.client.Do(req.WithContext(ctx))
+	if !timer.Stop() && atomic.LoadInt32(&timedOut) == 1 {
+		if err == nil {
+			res.Body.Close()
+		}
+		cancel()
+		return nil, &timeoutError{"Timeout awaiting response headers after " + firstByte.String()}
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res.Body = cancelBody{res.Body, cancel}
+	return res, nil
+}
+
+// cancelBody cancels the context of a request when the response body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
@@ -0,0 +1,95 @@
+package talon_access_proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestParseClientTimeout(t *testing.T) {
+	timeout, err := parseClientTimeout("1500")
+	require.NoError(t, err)
+	require.Equal(t, 1500*time.Millisecond, timeout)
+
+	timeout, err = parseClientTimeout("2s")
+	require.NoError(t, err)
+	require.Equal(t, 2*time.Second, timeout)
+
+	for _, value := range []string{"0", "-1s", "soon"} {
+		_, err = parseClientTimeout(value)
+		require.Equal(t, errInvalidTimeout, err, value)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	canceled := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-r.Context().Done():
+			canceled <- struct{}{}
+		}
+	}))
+	defer server.Close()
+
+	logger, err := zap.NewDevelopment()
+	require.NoError(t, err)
+	tap, err := New(Config{
+		TalonAPI: server.URL,
+		Logger:   logger,
+		Timeout: TimeoutConfig{
+			FirstByte: "20ms",
+			Routes: []TimeoutRoute{
+				{
+					Path:      "/v1/slow/**",
+					FirstByte: "1s",
+				},
+			},
+		},
+		// disable retries
+		Retry: RetryConfig{
+			Policies: []RetryPolicy{},
+		},
+	})
+	require.NoError(t, err)
+	defer tap.Close()
+
+	send := func(ctx context.Context, path, timeout string) int {
+		r := httptest.NewRequest(http.MethodGet, path, nil).WithContext(ctx)
+		if len(timeout) > 0 {
+			r.Header.Set("X-TAP-Timeout", timeout)
+		}
+		w := httptest.NewRecorder()
+		tap.Handler().ServeHTTP(w, r)
+		return w.Code
+	}
+
+	t.Run("First Byte", func(t *testing.T) {
+		require.Equal(t, http.StatusGatewayTimeout, send(context.Background(), "/v1/campaigns", ""))
+	})
+	t.Run("Route", func(t *testing.T) {
+		require.Equal(t, http.StatusOK, send(context.Background(), "/v1/slow/campaigns", ""))
+	})
+	t.Run("Client Timeout", func(t *testing.T) {
+		require.Equal(t, http.StatusGatewayTimeout, send(context.Background(), "/v1/slow/campaigns", "20ms"))
+		require.Equal(t, http.StatusBadRequest, send(context.Background(), "/v1/slow/campaigns", "soon"))
+	})
+	t.Run("Client Cancel", func(t *testing.T) {
+		for len(canceled) > 0 {
+			<-canceled
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		send(ctx, "/v1/slow/campaigns", "")
+		select {
+		case <-canceled:
+		case <-time.After(time.Second):
+			t.Fatal("upstream request was not canceled")
+		}
+	})
+}
@@ -0,0 +1,176 @@
+package talon_access_proxy
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// phaseTimings is the latency breakdown of a request, the phases of all upstream requests are summed up.
+// All methods can be called on a nil *phaseTimings, in that case nothing is recorded.
+type phaseTimings struct {
+	mu sync.Mutex
+	// DNS, Connect and TLS are the time spent on new connections
+	DNS     time.Duration
+	Connect time.Duration
+	TLS     time.Duration
+	// Wait is the time between sending the request and the first byte of the response
+	Wait time.Duration
+	// Headers is the time from receiving the request until the response headers were ready
+	Headers time.Duration
+	// Transfer is the time it took to copy the response body to the client
+	Transfer time.Duration
+	// Reused reports whether the last upstream request used an existing connection
+	Reused bool
+	// Attempts is the number of requests sent upstream
+	Attempts int
+}
+
+// clientTrace returns the httptrace hooks that record the phases of an upstream request
+func (p *phaseTimings) clientTrace() *httptrace.ClientTrace {
+	if p == nil {
+		return nil
+	}
+	// the hooks of parallel dials can be called concurrently
+	var dnsStart, tlsStart, wroteRequest time.Time
+	connectStart := make(map[string]time.Time)
+	return &httptrace.ClientTrace{
+		GetConn: func(string) {
+			p.mu.Lock()
+			p.Attempts++
+			p.mu.Unlock()
+		},
+		DNSStart: func(httptrace.DNSStartInfo) {
+			p.mu.Lock()
+			dnsStart = time.Now()
+			p.mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			p.mu.Lock()
+			p.DNS += time.Since(dnsStart)
+			p.mu.Unlock()
+		},
+		ConnectStart: func(network, addr string) {
+			p.mu.Lock()
+			connectStart[network+" "+addr] = time.Now()
+			p.mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			// only the dial that succeeded counts, parallel dials of other addresses are abandoned
+			if err != nil {
+				return
+			}
+			p.mu.Lock()
+			p.Connect += time.Since(connectStart[network+" "+addr])
+			p.mu.Unlock()
+		},
+		TLSHandshakeStart: func() {
+			p.mu.Lock()
+			tlsStart = time.Now()
+			p.mu.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			p.mu.Lock()
+			p.TLS += time.Since(tlsStart)
+			p.mu.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			p.mu.Lock()
+			p.Reused = info.Reused
+			p.mu.Unlock()
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			p.mu.Lock()
+			wroteRequest = time.Now()
+			p.mu.Unlock()
+		},
+		GotFirstResponseByte: func() {
+			p.mu.Lock()
+			if !wroteRequest.IsZero() {
+				p.Wait += time.Since(wroteRequest)
+			}
+			p.mu.Unlock()
+		},
+	}
+}
+
+// setHeaders records the time until the response headers are ready
+func (p *phaseTimings) setHeaders(d time.Duration) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.Headers = d
+	p.mu.Unlock()
+}
+
+// setTransfer records the time it took to copy the response body
+func (p *phaseTimings) setTransfer(d time.Duration) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	p.Transfer = d
+	p.mu.Unlock()
+}
+
+// serverTiming returns the value of the Server-Timing header, durations are in milliseconds, e.g.
+// dns;dur=1.2, connect;dur=0.8, tls;dur=12.5, wait;dur=40.1, total;dur=56.3, conn;desc=new
+func (p *phaseTimings) serverTiming() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var metrics []string
+	add := func(name string, d time.Duration) {
+		metrics = append(metrics, name+";dur="+strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 1, 64))
+	}
+	if p.DNS > 0 {
+		add("dns", p.DNS)
+	}
+	if p.Connect > 0 {
+		add("connect", p.Connect)
+	}
+	if p.TLS > 0 {
+		add("tls", p.TLS)
+	}
+	if p.Attempts > 0 {
+		add("wait", p.Wait)
+	}
+	add("total", p.Headers)
+	if p.Attempts > 0 {
+		if p.Reused {
+			metrics = append(metrics, "conn;desc=reused")
+		} else {
+			metrics = append(metrics, "conn;desc=new")
+		}
+	}
+	return strings.Join(metrics, ", ")
+}
+
+// setServerTiming adds the Server-Timing header if it is enabled, the metrics of the Talon API are kept
+func (p *phaseTimings) setServerTiming(header http.Header, config *TimingConfig) {
+	if p == nil || !config.ServerTiming {
+		return
+	}
+	header.Add("Server-Timing", p.serverTiming())
+}
+
+// MarshalLogObject adds the phases to a log line
+func (p *phaseTimings) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	enc.AddDuration("dns", p.DNS)
+	enc.AddDuration("connect", p.Connect)
+	enc.AddDuration("tls", p.TLS)
+	enc.AddDuration("wait", p.Wait)
+	enc.AddDuration("headers", p.Headers)
+	enc.AddDuration("transfer", p.Transfer)
+	enc.AddBool("reused", p.Reused)
+	enc.AddInt("attempts", p.Attempts)
+	return nil
+}
@@ -0,0 +1,89 @@
+package talon_access_proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestServerTiming(t *testing.T) {
+	p := &phaseTimings{
+		DNS:      1200 * time.Microsecond,
+		Connect:  800 * time.Microsecond,
+		Wait:     40 * time.Millisecond,
+		Headers:  56300 * time.Microsecond,
+		Attempts: 1,
+	}
+	require.Equal(t, "dns;dur=1.2, connect;dur=0.8, wait;dur=40.0, total;dur=56.3, conn;desc=new", p.serverTiming())
+
+	// responses that were not sent upstream only have a total
+	p = &phaseTimings{Headers: time.Millisecond}
+	require.Equal(t, "total;dur=1.0", p.serverTiming())
+}
+
+func TestTimings(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/applications" {
+			w.Header().Set("Server-Timing", "db;dur=5")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	logs := &logBuffer{}
+	logger := zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(logs), zap.InfoLevel))
+	tap, err := New(Config{
+		TalonAPI: server.URL,
+		Logger:   logger,
+		Timing: TimingConfig{
+			ServerTiming:  true,
+			SlowThreshold: "1ms",
+		},
+	})
+	require.NoError(t, err)
+	defer tap.Close()
+
+	send := func() string {
+		w := httptest.NewRecorder()
+		tap.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/campaigns", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		return w.Header().Get("Server-Timing")
+	}
+
+	logs.Lines(t)
+	timing := send()
+	require.Contains(t, timing, "connect;dur=")
+	require.Contains(t, timing, "wait;dur=")
+	require.Contains(t, timing, "total;dur=")
+	require.True(t, strings.HasSuffix(timing, "conn;desc=new"), timing)
+
+	var slow map[string]interface{}
+	for _, line := range logs.Lines(t) {
+		if line["msg"] == "Slow request" {
+			slow = line
+		}
+	}
+	require.NotNil(t, slow)
+	require.Equal(t, "/v1/campaigns", slow["path"])
+	timings := slow["timings"].(map[string]interface{})
+	require.True(t, timings["wait"].(float64) >= 0.005)
+	require.Equal(t, float64(1), timings["attempts"])
+
+	timing = send()
+	require.NotContains(t, timing, "connect;dur=")
+	require.True(t, strings.HasSuffix(timing, "conn;desc=reused"), timing)
+
+	// the metrics of the Talon API are kept
+	w := httptest.NewRecorder()
+	tap.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/applications", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Len(t, w.Header()["Server-Timing"], 2)
+	require.Equal(t, "db;dur=5", w.Header()["Server-Timing"][0])
+	require.Contains(t, w.Header()["Server-Timing"][1], "total;dur=")
+}
@@ -0,0 +1,549 @@
+package talon_access_proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// span kinds and status codes of the OTLP protocol
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+
+	spanStatusError = 2
+)
+
+// traceContext is the content of a W3C traceparent header
+type traceContext struct {
+	traceID [16]byte
+	spanID  [8]byte
+	sampled bool
+}
+
+// parseTraceparent parses a W3C traceparent header, e.g. 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func parseTraceparent(value string) (traceContext, bool) {
+	var tc traceContext
+	value = strings.TrimSpace(value)
+	if len(value) < 55 || value[2] != '-' || value[35] != '-' || value[52] != '-' {
+		return tc, false
+	}
+	for _, field := range []string{value[:2], value[3:35], value[36:52], value[53:55]} {
+		if !isLowerHex(field) {
+			return tc, false
+		}
+	}
+	version, _ := strconv.ParseUint(value[:2], 16, 8)
+	// version 00 has exactly four fields, future versions may append fields
+	if version == 0xff || (version == 0 && len(value) != 55) || (len(value) > 55 && value[55] != '-') {
+		return tc, false
+	}
+	hex.Decode(tc.traceID[:], []byte(value[3:35]))
+	hex.Decode(tc.spanID[:], []byte(value[36:52]))
+	if tc.traceID == ([16]byte{}) || tc.spanID == ([8]byte{}) {
+		return tc, false
+	}
+	flags, _ := strconv.ParseUint(value[53:55], 16, 8)
+	tc.sampled = flags&1 == 1
+	return tc, true
+}
+
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+type spanAttribute struct {
+	key   string
+	value interface{}
+}
+
+// span is a timed operation of a trace.
+// All methods can be called on a nil *span, in that case nothing is recorded.
+type span struct {
+	tracer   *tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	// state is the tracestate header of the caller, it is propagated unchanged
+	state   string
+	sampled bool
+	name    string
+	kind    int
+	start   time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes []spanAttribute
+	errored    bool
+	message    string
+}
+
+// child starts a span whose parent is s
+func (s *span) child(name string, kind int) *span {
+	if s == nil {
+		return nil
+	}
+	c := &span{
+		tracer:   s.tracer,
+		traceID:  s.traceID,
+		parentID: s.spanID,
+		state:    s.state,
+		sampled:  s.sampled,
+		name:     name,
+		kind:     kind,
+		start:    time.Now(),
+	}
+	rand.Read(c.spanID[:])
+	return c
+}
+
+// SetName renames the span
+func (s *span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.name = name
+	s.mu.Unlock()
+}
+
+// SetAttribute adds an attribute, value is a string, int or bool
+func (s *span) SetAttribute(key string, value interface{}) {
+	if s == nil || !s.sampled {
+		return
+	}
+	s.mu.Lock()
+	s.attributes = append(s.attributes, spanAttribute{key, value})
+	s.mu.Unlock()
+}
+
+// SetError marks the span as failed
+func (s *span) SetError(message string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.errored = true
+	s.message = message
+	s.mu.Unlock()
+}
+
+// End finishes the span and queues it for the export, only the first call has an effect
+func (s *span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.mu.Unlock()
+	if s.sampled {
+		s.tracer.enqueue(s)
+	}
+}
+
+// TraceID returns the hex encoded trace id
+func (s *span) TraceID() string {
+	if s == nil {
+		return ""
+	}
+	return hex.EncodeToString(s.traceID[:])
+}
+
+// traceparent returns the W3C traceparent header that makes s the parent of the receiver
+func (s *span) traceparent() string {
+	flags := "00"
+	if s.sampled {
+		flags = "01"
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-" + flags
+}
+
+// clientTrace returns the httptrace hooks that record the DNS lookup, connect and TLS handshake as children of s
+func (s *span) clientTrace() *httptrace.ClientTrace {
+	if s == nil || !s.sampled {
+		return nil
+	}
+	// the hooks of parallel dials can be called concurrently
+	var mu sync.Mutex
+	var dns, handshake *span
+	connects := make(map[string]*span)
+	return &httptrace.ClientTrace{
+		DNSStart: func(info httptrace.DNSStartInfo) {
+			c := s.child("dns", spanKindInternal)
+			c.SetAttribute("net.host.name", info.Host)
+			mu.Lock()
+			dns = c
+			mu.Unlock()
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			mu.Lock()
+			c := dns
+			mu.Unlock()
+			if info.Err != nil {
+				c.SetError(info.Err.Error())
+			}
+			addresses := make([]string, len(info.Addrs))
+			for i, addr := range info.Addrs {
+				addresses[i] = addr.String()
+			}
+			c.SetAttribute("net.host.addresses", strings.Join(addresses, ","))
+			c.End()
+		},
+		ConnectStart: func(network, addr string) {
+			c := s.child("connect", spanKindInternal)
+			c.SetAttribute("net.transport", network)
+			c.SetAttribute("net.peer.address", addr)
+			mu.Lock()
+			connects[network+" "+addr] = c
+			mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mu.Lock()
+			c := connects[network+" "+addr]
+			mu.Unlock()
+			if err != nil {
+				c.SetError(err.Error())
+			}
+			c.End()
+		},
+		TLSHandshakeStart: func() {
+			c := s.child("tls", spanKindInternal)
+			mu.Lock()
+			handshake = c
+			mu.Unlock()
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			mu.Lock()
+			c := handshake
+			mu.Unlock()
+			if err != nil {
+				c.SetError(err.Error())
+			}
+			c.SetAttribute("tls.server_name", state.ServerName)
+			c.SetAttribute("tls.resumed", state.DidResume)
+			c.End()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			s.SetAttribute("net.connection.reused", info.Reused)
+		},
+	}
+}
+
+// startUpstreamSpan starts the span of a request to an upstream and sets the trace headers of req,
+// it returns nil if the request is not traced
+func startUpstreamSpan(req *http.Request) *span {
+	s := getRequestInfo(req.Context()).Span.child("HTTP "+req.Method, spanKindClient)
+	if s == nil {
+		return nil
+	}
+	s.SetAttribute("http.method", req.Method)
+	s.SetAttribute("http.url", req.URL.String())
+	s.SetAttribute("net.peer.name", req.URL.Host)
+	req.Header.Set("traceparent", s.traceparent())
+	if len(s.state) > 0 {
+		req.Header.Set("tracestate", s.state)
+	} else {
+		req.Header.Del("tracestate")
+	}
+	return s
+}
+
+// endUpstream records the outcome of a request to an upstream, the span ends when the response body is closed
+func (s *span) endUpstream(res *http.Response, err error) {
+	if s == nil {
+		return
+	}
+	if err != nil {
+		s.SetError(err.Error())
+		s.End()
+		return
+	}
+	s.SetAttribute("http.status_code", res.StatusCode)
+	if res.StatusCode >= 500 {
+		s.SetError(http.StatusText(res.StatusCode))
+	}
+	res.Body = spanBody{res.Body, s}
+}
+
+// spanBody ends a span when the response body is closed
+type spanBody struct {
+	io.ReadCloser
+	span *span
+}
+
+func (b spanBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.span.End()
+	return err
+}
+
+// tracer creates the spans of incoming requests and exports them to an OTLP/HTTP collector.
+// All methods can be called on a nil *tracer, in that case nothing is traced.
+type tracer struct {
+	config *TracingConfig
+	logger *zap.Logger
+	client http.Client
+	queue  chan *span
+	// dropped counts the spans that did not fit into the queue
+	dropped uint64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newTracer(config *TracingConfig, logger *zap.Logger) *tracer {
+	return &tracer{
+		config: config,
+		logger: logger.With(zap.String("tag", "Tracing")),
+		client: http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan *span, config.MaxQueueSize),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// startRequest starts the span of an incoming request, it continues the trace of the traceparent header
+func (tr *tracer) startRequest(r *http.Request) *span {
+	if tr == nil {
+		return nil
+	}
+	s := &span{
+		tracer: tr,
+		name:   r.Method + " " + normalizePath(r.URL.Path),
+		kind:   spanKindServer,
+		start:  time.Now(),
+	}
+	if parent, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+		s.sampled = parent.sampled
+		s.state = strings.Join(r.Header["Tracestate"], ",")
+	} else {
+		rand.Read(s.traceID[:])
+		s.sampled = tr.sample(s.traceID)
+	}
+	rand.Read(s.spanID[:])
+	s.SetAttribute("http.method", r.Method)
+	s.SetAttribute("http.target", r.URL.RequestURI())
+	return s
+}
+
+// sample decides whether a new trace is recorded, the decision is derived from the trace id
+func (tr *tracer) sample(traceID [16]byte) bool {
+	rate := *tr.config.SampleRate
+	if rate >= 1 {
+		return true
+	}
+	return binary.BigEndian.Uint64(traceID[8:])>>1 < uint64(rate*(1<<63))
+}
+
+func (tr *tracer) enqueue(s *span) {
+	select {
+	case tr.queue <- s:
+	default:
+		if atomic.AddUint64(&tr.dropped, 1) == 1 {
+			tr.logger.Warn("Span queue is full, dropping spans")
+		}
+	}
+}
+
+// Run exports the spans every FlushInterval or whenever a batch is full, until Close is called
+func (tr *tracer) Run() {
+	defer close(tr.done)
+	ticker := time.NewTicker(tr.config.flushInterval)
+	defer ticker.Stop()
+	batch := make([]*span, 0, tr.config.MaxBatchSize)
+	for {
+		select {
+		case s := <-tr.queue:
+			batch = append(batch, s)
+			if len(batch) >= tr.config.MaxBatchSize {
+				tr.export(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			tr.export(batch)
+			batch = batch[:0]
+		case <-tr.stop:
+			for {
+				select {
+				case s := <-tr.queue:
+					batch = append(batch, s)
+					if len(batch) >= tr.config.MaxBatchSize {
+						tr.export(batch)
+						batch = batch[:0]
+					}
+				default:
+					tr.export(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// Close exports the remaining spans and stops Run
+func (tr *tracer) Close() {
+	close(tr.stop)
+	<-tr.done
+}
+
+// export sends the spans to the collector
+func (tr *tracer) export(spans []*span) {
+	if len(spans) <= 0 {
+		return
+	}
+	body, err := json.Marshal(tr.encode(spans))
+	if err != nil {
+		tr.logger.Error("Unable to encode spans", zap.Error(err))
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, tr.config.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		tr.logger.Error("Unable to create export request", zap.Error(err))
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range tr.config.Headers {
+		req.Header.Set(k, v)
+	}
+	res, err := tr.client.Do(req)
+	if err != nil {
+		tr.logger.Warn("Unable to export spans", zap.Int("spans", len(spans)), zap.Error(err))
+		return
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		tr.logger.Warn("Collector rejected spans", zap.Int("spans", len(spans)), zap.Int("statusCode", res.StatusCode))
+	}
+}
+
+// OTLP/HTTP JSON encoding, see https://github.com/open-telemetry/opentelemetry-proto
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	TraceState        string          `json:"traceState,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+func newOTLPAttribute(key string, value interface{}) otlpAttribute {
+	a := otlpAttribute{Key: key}
+	switch v := value.(type) {
+	case int:
+		s := strconv.Itoa(v)
+		a.Value.IntValue = &s
+	case bool:
+		a.Value.BoolValue = &v
+	case string:
+		a.Value.StringValue = &v
+	}
+	return a
+}
+
+func (tr *tracer) encode(spans []*span) *otlpTraces {
+	list := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		s.mu.Lock()
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			TraceState:        s.state,
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID != ([8]byte{}) {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for _, a := range s.attributes {
+			o.Attributes = append(o.Attributes, newOTLPAttribute(a.key, a.value))
+		}
+		if s.errored {
+			o.Status = otlpStatus{Code: spanStatusError, Message: s.message}
+		}
+		s.mu.Unlock()
+		list[i] = o
+	}
+	return &otlpTraces{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpAttribute{newOTLPAttribute("service.name", tr.config.ServiceName)},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "talon-access-proxy", Version: Version},
+				Spans: list,
+			}},
+		}},
+	}
+}
@@ -0,0 +1,167 @@
+package talon_access_proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		value   string
+		ok      bool
+		sampled bool
+	}{
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false},
+		{"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future", true, true},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future", false, false},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false, false},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", false, false},
+		{"", false, false},
+	}
+	for _, test := range tests {
+		tc, ok := parseTraceparent(test.value)
+		require.Equal(t, test.ok, ok, test.value)
+		require.Equal(t, test.sampled, tc.sampled, test.value)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	var mu sync.Mutex
+	var spans []otlpSpan
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		require.Equal(t, "secret", r.Header.Get("X-Api-Key"))
+		var traces otlpTraces
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&traces))
+		mu.Lock()
+		for _, resourceSpans := range traces.ResourceSpans {
+			require.Equal(t, "tap", *resourceSpans.Resource.Attributes[0].Value.StringValue)
+			for _, scopeSpans := range resourceSpans.ScopeSpans {
+				spans = append(spans, scopeSpans.Spans...)
+			}
+		}
+		mu.Unlock()
+	}))
+	defer collector.Close()
+
+	var traceparents []string
+	var tracestates []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		traceparents = append(traceparents, r.Header.Get("traceparent"))
+		tracestates = append(tracestates, r.Header.Get("tracestate"))
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	newTap := func(rate float64) *Tap {
+		logger, err := zap.NewDevelopment()
+		require.NoError(t, err)
+		tap, err := New(Config{
+			TalonAPI: server.URL,
+			Logger:   logger,
+			Tracing: &TracingConfig{
+				Endpoint:      collector.URL,
+				Headers:       map[string]string{"X-Api-Key": "secret"},
+				ServiceName:   "tap",
+				SampleRate:    &rate,
+				FlushInterval: "1h",
+			},
+		})
+		require.NoError(t, err)
+		return tap
+	}
+	send := func(tap *Tap, traceparent string) {
+		r := httptest.NewRequest(http.MethodGet, "/v1/campaigns/1", nil)
+		if len(traceparent) > 0 {
+			r.Header.Set("traceparent", traceparent)
+			r.Header.Set("tracestate", "vendor=value")
+		}
+		w := httptest.NewRecorder()
+		tap.Handler().ServeHTTP(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+	reset := func() {
+		mu.Lock()
+		spans, traceparents, tracestates = nil, nil, nil
+		mu.Unlock()
+	}
+
+	t.Run("Continue trace", func(t *testing.T) {
+		reset()
+		tap := newTap(1)
+		send(tap, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+		// Close exports the remaining spans
+		tap.Close()
+
+		require.Len(t, traceparents, 1)
+		upstream, ok := parseTraceparent(traceparents[0])
+		require.True(t, ok)
+		require.True(t, upstream.sampled)
+		require.Equal(t, "vendor=value", tracestates[0])
+
+		byName := make(map[string]otlpSpan)
+		for _, s := range spans {
+			require.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", s.TraceID)
+			byName[s.Name] = s
+		}
+		require.Contains(t, byName, "GET /v1/campaigns/:id")
+		require.Contains(t, byName, "HTTP GET")
+		require.Contains(t, byName, "connect")
+		serverSpan, clientSpan := byName["GET /v1/campaigns/:id"], byName["HTTP GET"]
+		require.Equal(t, spanKindServer, serverSpan.Kind)
+		require.Equal(t, "00f067aa0ba902b7", serverSpan.ParentSpanID)
+		require.Equal(t, "vendor=value", serverSpan.TraceState)
+		require.Equal(t, spanKindClient, clientSpan.Kind)
+		require.Equal(t, serverSpan.SpanID, clientSpan.ParentSpanID)
+		require.Equal(t, clientSpan.SpanID, byName["connect"].ParentSpanID)
+		// the upstream sees the round trip as its parent
+		require.Equal(t, clientSpan.SpanID, strings.Split(traceparents[0], "-")[2])
+	})
+
+	t.Run("Not sampled", func(t *testing.T) {
+		reset()
+		tap := newTap(1)
+		send(tap, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+		tap.Close()
+
+		require.Empty(t, spans)
+		upstream, ok := parseTraceparent(traceparents[0])
+		require.True(t, ok)
+		require.False(t, upstream.sampled)
+	})
+
+	t.Run("Sample rate", func(t *testing.T) {
+		reset()
+		tap := newTap(0)
+		send(tap, "")
+		tap.Close()
+
+		require.Empty(t, spans)
+		upstream, ok := parseTraceparent(traceparents[0])
+		require.True(t, ok)
+		require.False(t, upstream.sampled)
+
+		reset()
+		tap = newTap(1)
+		send(tap, "")
+		tap.Close()
+
+		require.NotEmpty(t, spans)
+		upstream, ok = parseTraceparent(traceparents[0])
+		require.True(t, ok)
+		require.True(t, upstream.sampled)
+		require.Empty(t, tracestates[0])
+	})
+}
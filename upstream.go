@@ -0,0 +1,208 @@
+package talon_access_proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// upstream is a Talon API endpoint, it keeps track of its health
+type upstream struct {
+	url    url.URL
+	config *FailoverConfig
+	logger *zap.Logger
+
+	mu sync.Mutex
+	// consecutive connection failures
+	failures int
+	// ring buffer of the last responses, true if it was a 5xx response
+	results     []bool
+	resultIndex int
+	resultCount int
+	downUntil   time.Time
+}
+
+func newUpstream(u url.URL, config *FailoverConfig, logger *zap.Logger) *upstream {
+	return &upstream{
+		url:     u,
+		config:  config,
+		logger:  logger.With(zap.String("upstream", u.Host)),
+		results: make([]bool, config.Window),
+	}
+}
+
+// Healthy reports whether the upstream can be used, an upstream that is down
+// becomes healthy again after the cooldown, so the next request probes it
+func (u *upstream) Healthy(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !now.Before(u.downUntil)
+}
+
+// Report records the result of a request
+func (u *upstream) Report(res *http.Response, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if err != nil {
+		if !isConnectionError(err) {
+			return
+		}
+		u.failures++
+		// a failed probe after the cooldown marks the upstream down right away
+		if u.failures >= u.config.FailureThreshold || !u.downUntil.IsZero() {
+			u.markDown("connection failures")
+		}
+		return
+	}
+
+	wasDown := !u.downUntil.IsZero()
+	u.failures = 0
+	u.results[u.resultIndex] = res.StatusCode >= 500
+	u.resultIndex = (u.resultIndex + 1) % len(u.results)
+	if u.resultCount < len(u.results) {
+		u.resultCount++
+	}
+
+	if u.resultCount >= u.config.MinRequests {
+		var serverErrors int
+		for i := 0; i < u.resultCount; i++ {
+			if u.results[i] {
+				serverErrors++
+			}
+		}
+		if float64(serverErrors)/float64(u.resultCount) >= u.config.ErrorRate {
+			u.markDown("error rate")
+			return
+		}
+	}
+
+	if wasDown {
+		// this was a probe after the cooldown
+		if res.StatusCode >= 500 {
+			u.markDown("probe failed")
+			return
+		}
+		u.downUntil = time.Time{}
+		u.logger.Info("Upstream recovered")
+	}
+}
+
+func (u *upstream) markDown(reason string) {
+	u.downUntil = time.Now().Add(u.config.cooldown)
+	u.failures = 0
+	u.resultIndex = 0
+	u.resultCount = 0
+	u.logger.Warn("Upstream is down", zap.String("reason", reason), zap.Time("until", u.downUntil))
+}
+
+// upstreams is the ordered list of Talon API endpoints
+type upstreams []*upstream
+
+// Candidates returns the healthy upstreams in order, followed by the ones that are down
+func (list upstreams) Candidates() []*upstream {
+	now := time.Now()
+	candidates := make([]*upstream, 0, len(list))
+	var down []*upstream
+	for _, u := range list {
+		if u.Healthy(now) {
+			candidates = append(candidates, u)
+		} else {
+			down = append(down, u)
+		}
+	}
+	return append(candidates, down...)
+}
+
+// Active returns the upstream that will be used for the next request
+func (list upstreams) Active() *upstream {
+	return list.Candidates()[0]
+}
+
+// isConnectionError reports whether err happened before the request was sent
+func isConnectionError(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
+
+// roundTrip sends req to the first healthy upstream, if it can not be reached
+// and the body is replayable the next upstream is tried.
+// Upstreams whose circuit breaker is open are skipped.
+func (t *Tap) roundTrip(logger *zap.Logger, req *http.Request) (*http.Response, error) {
+	info := getRequestInfo(req.Context())
+	var res *http.Response
+	var err error
+	var sent bool
+	retryAfter := time.Duration(-1)
+	for _, u := range t.upstreams.Candidates() {
+		var breaker *circuitBreaker
+		if t.breakers != nil {
+			breaker = t.breakers.Get(u.url.Host, info.ApplicationID)
+			if ok, wait := breaker.Allow(); !ok {
+				logger.Debug("Circuit breaker is open, skipping upstream", zap.String("upstream", u.url.Host))
+				if retryAfter < 0 || wait < retryAfter {
+					retryAfter = wait
+				}
+				continue
+			}
+		}
+		if sent {
+			if !rewindBody(req) {
+				if breaker != nil {
+					breaker.Cancel()
+				}
+				break
+			}
+			logger.Warn("Failing over to next upstream", zap.String("upstream", u.url.Host), zap.String("error", err.Error()))
+		}
+		req.URL.Host = u.url.Host
+		req.URL.Scheme = u.url.Scheme
+		start := time.Now()
+		t.instruments.upstreamStart(u.url.Host)
+		span := startUpstreamSpan(req)
+		res, err = t.send(req, info.FirstByteTimeout, span)
+		duration := time.Since(start)
+		t.instruments.upstreamDone(u.url.Host, res, err, duration)
+		if err == nil || req.Context().Err() != context.Canceled {
+			// requests the client canceled say nothing about the Talon API
+			t.limiter.Observe(duration, err != nil)
+		}
+		span.endUpstream(res, err)
+		info.Upstream = u.url.Host
+		if err == nil {
+			info.UpstreamStatus = res.StatusCode
+		}
+		sent = true
+		// failures because the client went away or its timeout expired say nothing about the upstream
+		canceled := err != nil && req.Context().Err() != nil
+		if !canceled {
+			u.Report(res, err)
+		}
+		if breaker != nil {
+			if canceled {
+				breaker.Cancel()
+			} else {
+				breaker.Report(err != nil || res.StatusCode >= 500 || (t.Config.CircuitBreaker.slowThreshold > 0 && time.Since(start) > t.Config.CircuitBreaker.slowThreshold))
+			}
+		}
+		if err == nil {
+			res.Header.Set("X-TAP-Upstream", u.url.Host)
+			return res, nil
+		}
+		if canceled || !isConnectionError(err) {
+			break
+		}
+	}
+	if !sent && retryAfter >= 0 {
+		return nil, &circuitOpenError{retryAfter: retryAfter}
+	}
+	return nil, err
+}
@@ -0,0 +1,151 @@
+package talon_access_proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestFailover(t *testing.T) {
+	var primaryStatus = http.StatusOK
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(primaryStatus)
+	}))
+	defer primary.Close()
+	backup := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backup.Close()
+	unreachable := httptest.NewServer(nil)
+	unreachable.Close()
+
+	host := func(s string) string {
+		u, err := url.Parse(s)
+		require.NoError(t, err)
+		return u.Host
+	}
+
+	logs := &logBuffer{}
+	newTap := func(apis ...string) *Tap {
+		logger := zap.New(zapcore.NewCore(zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()), zapcore.AddSync(logs), zap.DebugLevel))
+		tap, err := New(Config{
+			TalonAPI:         apis[0],
+			FailoverTalonAPI: apis[1:],
+			Failover: FailoverConfig{
+				FailureThreshold: 1,
+				Window:           4,
+				MinRequests:      4,
+				Cooldown:         "50ms",
+			},
+			// disable retries
+			Retry: RetryConfig{
+				Policies: []RetryPolicy{},
+			},
+			Logger: logger,
+		})
+		require.NoError(t, err)
+		return tap
+	}
+
+	send := func(tap *Tap, method string) *httptest.ResponseRecorder {
+		var r *http.Request
+		if method == http.MethodGet {
+			r = httptest.NewRequest(method, "/v1/customer_sessions/1", nil)
+		} else {
+			r = httptest.NewRequest(method, "/v1/customer_sessions/1", strings.NewReader("{}"))
+		}
+		w := httptest.NewRecorder()
+		tap.Handler().ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("Connection Failure", func(t *testing.T) {
+		tap := newTap(unreachable.URL, backup.URL)
+		defer tap.Close()
+
+		// the body of an incoming request can not be replayed
+		w := send(tap, http.MethodPut)
+		require.Equal(t, http.StatusBadGateway, w.Code)
+
+		// the primary is down now
+		w = send(tap, http.MethodPut)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, host(backup.URL), w.Header().Get("X-TAP-Upstream"))
+	})
+
+	t.Run("Connection Failure without body", func(t *testing.T) {
+		tap := newTap(unreachable.URL, backup.URL)
+		defer tap.Close()
+		logs.Lines(t)
+		w := send(tap, http.MethodGet)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, host(backup.URL), w.Header().Get("X-TAP-Upstream"))
+
+		// the upstream that answered the request is logged
+		var succeeded map[string]interface{}
+		for _, line := range logs.Lines(t) {
+			if line["msg"] == "Request succeeded" {
+				succeeded = line
+			}
+		}
+		require.NotNil(t, succeeded)
+		require.Equal(t, host(backup.URL), succeeded["upstream"])
+	})
+
+	t.Run("Client Timeout", func(t *testing.T) {
+		var backupRequests int32
+		backup := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&backupRequests, 1)
+		}))
+		defer backup.Close()
+		tap := newTap(primary.URL, backup.URL)
+		defer tap.Close()
+		// the dial only fails because the request timed out, older transports report the dial error in that case
+		tap.client.Transport = transportFunc(func(req *http.Request) (*http.Response, error) {
+			<-req.Context().Done()
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: req.Context().Err()}
+		})
+
+		r := httptest.NewRequest(http.MethodGet, "/v1/customer_sessions/1", nil)
+		r.Header.Set("X-TAP-Timeout", "10ms")
+		w := httptest.NewRecorder()
+		tap.Handler().ServeHTTP(w, r)
+		require.Equal(t, http.StatusGatewayTimeout, w.Code)
+		require.True(t, tap.upstreams[0].Healthy(time.Now()))
+		require.Equal(t, int32(0), atomic.LoadInt32(&backupRequests))
+	})
+
+	t.Run("Error Rate and Failback", func(t *testing.T) {
+		tap := newTap(primary.URL, backup.URL)
+		defer tap.Close()
+
+		primaryStatus = http.StatusBadGateway
+		for i := 0; i < 4; i++ {
+			w := send(tap, http.MethodGet)
+			require.Equal(t, http.StatusBadGateway, w.Code)
+			require.Equal(t, host(primary.URL), w.Header().Get("X-TAP-Upstream"))
+		}
+		w := send(tap, http.MethodGet)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, host(backup.URL), w.Header().Get("X-TAP-Upstream"))
+
+		primaryStatus = http.StatusOK
+		time.Sleep(60 * time.Millisecond)
+		w = send(tap, http.MethodGet)
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, host(primary.URL), w.Header().Get("X-TAP-Upstream"))
+	})
+}
+
+type transportFunc func(*http.Request) (*http.Response, error)
+
+func (f transportFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}